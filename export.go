@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/storage"
+	workers_pkg "github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+// offline export of the event log or ping samples, e.g. "device-pinger export -format csv -target 192.168.0.1 -from 2024-01-01T00:00:00Z > events.csv",
+// reads PINGER_DB_FILE unless -db is given, writes to stdout unless -out is given
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbFile := fs.String("db", registry.Config.DbFile, "sqlite file of the event log")
+	format := fs.String("format", storage.FORMAT_CSV, "csv or jsonl")
+	kind := fs.String("kind", storage.KIND_EVENTS, "events or samples")
+	targets := fs.String("target", "", "comma separated targets, all when empty")
+	from := fs.String("from", "", "start of the range, RFC 3339")
+	to := fs.String("to", "", "end of the range, RFC 3339")
+	out := fs.String("out", "", "output file, stdout when empty")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "export failed:", err)
+		return 1
+	}
+	if *dbFile == "" {
+		return fail(storage.ErrDisabled)
+	}
+	if err := storage.CheckFormat(*format); err != nil {
+		return fail(err)
+	}
+	if err := storage.CheckKind(*kind); err != nil {
+		return fail(err)
+	}
+	q := storage.ExportQuery{Kind: *kind}
+	for _, t := range strings.Split(*targets, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			q.Targets = append(q.Targets, workers_pkg.TargetAddr(t))
+		}
+	}
+	var err error
+	if *from != "" {
+		if q.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			return fail(err)
+		}
+	}
+	if *to != "" {
+		if q.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fail(err)
+		}
+	}
+	if err := storage.OpenFile(*dbFile); err != nil {
+		return fail(err)
+	}
+	defer storage.Close()
+	file := os.Stdout
+	if *out != "" {
+		if file, err = os.Create(*out); err != nil {
+			return fail(err)
+		}
+		defer file.Close()
+	}
+	w := bufio.NewWriter(file)
+	count, err := storage.Export(w, *format, q)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d %s\n", count, *kind)
+	return 0
+}
@@ -0,0 +1,460 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/auth"
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/jsonlog"
+	"github.com/fedulovivan/device-pinger/internal/logger"
+	"github.com/fedulovivan/device-pinger/internal/mqtt"
+	"github.com/fedulovivan/device-pinger/internal/schema"
+	"github.com/fedulovivan/device-pinger/internal/storage"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+	"github.com/fedulovivan/mhz19-go/pkg/utils"
+)
+
+var tagBase = utils.NewTag(logger.TAG_HTTP)
+
+// limits of /log response, when limit param is omitted or is too big
+const (
+	LOG_DEFAULT_LIMIT = 1000
+	LOG_MAX_LIMIT     = 10000
+)
+
+// request bodies are small json objects, larger ones are rejected without reading them fully
+const MAX_BODY_SIZE = 64 * 1024
+
+var workersCollection *workers.Collection
+
+type Response struct {
+	Message string `json:"message"`
+	IsError bool   `json:"error"`
+}
+
+type CreateRequest struct {
+	Target   workers.TargetAddr `json:"target" jsonschema:"required"`
+	Name     string             `json:"name"`
+	Labels   map[string]string  `json:"labels"`
+	Schedule string             `json:"schedule"`
+	Parent   workers.TargetAddr `json:"parent"`
+}
+
+// all fields are optional, only the ones present in request body are updated
+type PatchRequest struct {
+	Name     *string             `json:"name"`
+	Labels   *map[string]string  `json:"labels"`
+	Schedule *string             `json:"schedule"`
+	Parent   *workers.TargetAddr `json:"parent"`
+}
+
+// register rest api handlers, backed by the same collection methods as mqtt api
+func Register(mux *http.ServeMux, wc *workers.Collection) {
+	workersCollection = wc
+	mux.HandleFunc("GET /targets", protected("list", listTargets))
+	mux.HandleFunc("GET /targets/{addr}", protected("get", getTarget))
+	mux.HandleFunc("POST /targets", protected("add", createTarget))
+	mux.HandleFunc("PATCH /targets/{addr}", protected("patch", patchTarget))
+	mux.HandleFunc("DELETE /targets/{addr}", protected("del", deleteTarget))
+	mux.HandleFunc("GET /targets/{addr}/history", protected("history", getHistory))
+	mux.HandleFunc("GET /targets/{addr}/report", protected("report", getReport))
+	mux.HandleFunc("POST /targets/{addr}/pause", protected("pause", pauseTarget))
+	mux.HandleFunc("POST /targets/{addr}/resume", protected("resume", resumeTarget))
+	mux.HandleFunc("GET /log", protected("log", getLog))
+	mux.HandleFunc("GET /daily", protected("daily", getDaily))
+	mux.HandleFunc("GET /export", protected("export", exportEvents))
+	mux.HandleFunc("GET /stats", protected("get-stats", getStats))
+	mux.HandleFunc("GET /events", protected("events", streamEvents))
+	// profiles expose process internals, so they require api token as well
+	mux.HandleFunc("/debug/pprof/", protected("pprof", pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", protected("pprof", pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", protected("pprof", pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", protected("pprof", pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", protected("pprof", pprof.Trace))
+	// health probes and documentation stay open, as well as /metrics registered in main
+	mux.HandleFunc("GET /healthz", liveness)
+	mux.HandleFunc("GET /readyz", readiness)
+	mux.HandleFunc("GET /openapi.json", getOpenapi)
+	mux.HandleFunc("GET /schemas", listSchemas)
+	mux.HandleFunc("GET /schemas/{name}", getSchema)
+}
+
+func writeJson(w http.ResponseWriter, code int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to write response"), "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, workers.ErrNotExist):
+		code = http.StatusNotFound
+	case errors.Is(err, workers.ErrAlreadyExist),
+		errors.Is(err, workers.ErrAlreadyPaused),
+		errors.Is(err, workers.ErrNotPaused):
+		code = http.StatusConflict
+	case errors.Is(err, errBadRequest),
+		errors.Is(err, storage.ErrUnknownFormat),
+		errors.Is(err, storage.ErrUnknownKind),
+		errors.Is(err, workers.ErrInvalidSchedule),
+		errors.Is(err, workers.ErrInvalidParent):
+		code = http.StatusBadRequest
+	case errors.Is(err, errBodyTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, storage.ErrDisabled):
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, auth.ErrUnauthorized):
+		code = http.StatusUnauthorized
+	case errors.Is(err, auth.ErrForbidden):
+		code = http.StatusForbidden
+	}
+	counters.Errors.Inc()
+	slog.Error(tagBase.F("Error"), "code", code, "err", err)
+	if rec, ok := w.(*recorder); ok {
+		rec.message = err.Error()
+	}
+	writeJson(w, code, Response{Message: err.Error(), IsError: true})
+}
+
+var (
+	errBadRequest   = errors.New("bad request")
+	errBodyTooLarge = errors.New("request body too large")
+)
+
+// body is validated against schema of dst first, to report unknown fields and wrong types precisely
+func decodeBody(w http.ResponseWriter, r *http.Request, dst any) error {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE))
+	if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+		return fmt.Errorf("%w, limit is %d bytes", errBodyTooLarge, maxErr.Limit)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadRequest, err)
+	}
+	err = schema.Validate(schema.For(dst), body)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadRequest, err)
+	}
+	err = json.Unmarshal(body, dst)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadRequest, err)
+	}
+	return nil
+}
+
+// require api token, when PINGER_API_TOKENS is set
+func protected(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := workers.TargetAddr(r.PathValue("addr"))
+		jsonlog.Command("http", action, target, 0)
+		rec := &recorder{ResponseWriter: w, code: http.StatusOK}
+		defer func() {
+			jsonlog.HttpResult(action, target, rec.code, rec.message)
+		}()
+		if err := auth.CheckToken(r); err != nil {
+			auth.Reject("http", action)
+			writeError(rec, err)
+			return
+		}
+		handler(rec, r)
+	}
+}
+
+// captures status code and error message of the response for the json lines log
+type recorder struct {
+	http.ResponseWriter
+	code    int
+	message string
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	rec.code = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// streaming handlers (events, export) require flusher
+func (rec *recorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func handled(r *http.Request, action string, target workers.TargetAddr) {
+	slog.Debug(tagBase.F("Handled"), "method", r.Method, "path", r.URL.Path)
+	counters.ActionsHandled.WithLabelValues("http-"+action, string(target)).Inc()
+}
+
+func listTargets(w http.ResponseWriter, r *http.Request) {
+	res := []workers.TargetInfo{}
+	for _, worker := range workersCollection.List() {
+		res = append(res, worker.Info())
+	}
+	handled(r, "list", "")
+	writeJson(w, http.StatusOK, res)
+}
+
+func getTarget(w http.ResponseWriter, r *http.Request) {
+	target := workers.TargetAddr(r.PathValue("addr"))
+	worker, err := workersCollection.Get(target)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	handled(r, "get", target)
+	info := worker.Info()
+	report := worker.Report()
+	info.Report = &report
+	writeJson(w, http.StatusOK, info)
+}
+
+func getReport(w http.ResponseWriter, r *http.Request) {
+	target := workers.TargetAddr(r.PathValue("addr"))
+	worker, err := workersCollection.Get(target)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	handled(r, "report", target)
+	writeJson(w, http.StatusOK, worker.Report())
+}
+
+func createTarget(w http.ResponseWriter, r *http.Request) {
+	req := CreateRequest{}
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Target == "" {
+		writeError(w, fmt.Errorf("%w: target is required", errBadRequest))
+		return
+	}
+	worker, err := workersCollection.Create(req.Target, workers.Meta{Name: req.Name, Labels: req.Labels, Schedule: req.Schedule, Parent: req.Parent})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	handled(r, "add", req.Target)
+	writeJson(w, http.StatusCreated, worker.Info())
+}
+
+func patchTarget(w http.ResponseWriter, r *http.Request) {
+	target := workers.TargetAddr(r.PathValue("addr"))
+	req := PatchRequest{}
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	worker, err := workersCollection.UpdateMeta(target, func(meta *workers.Meta) {
+		if req.Name != nil {
+			meta.Name = *req.Name
+		}
+		if req.Labels != nil {
+			meta.Labels = *req.Labels
+		}
+		if req.Schedule != nil {
+			meta.Schedule = *req.Schedule
+		}
+		if req.Parent != nil {
+			meta.Parent = *req.Parent
+		}
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	handled(r, "patch", target)
+	writeJson(w, http.StatusOK, worker.Info())
+}
+
+func deleteTarget(w http.ResponseWriter, r *http.Request) {
+	target := workers.TargetAddr(r.PathValue("addr"))
+	err := workersCollection.Delete(target)
+	runtime.GC()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	handled(r, "del", target)
+	writeJson(w, http.StatusOK, Response{Message: "deleted"})
+}
+
+// ?from=<RFC 3339>&to=<RFC 3339>&limit=<n>, all params are optional
+func parseHistoryQuery(r *http.Request) (workers.HistoryQuery, error) {
+	q := workers.HistoryQuery{}
+	params := r.URL.Query()
+	var err error
+	if v := params.Get("from"); v != "" {
+		if q.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("%w: from: %w", errBadRequest, err)
+		}
+	}
+	if v := params.Get("to"); v != "" {
+		if q.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("%w: to: %w", errBadRequest, err)
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("%w: limit should be non-negative integer", errBadRequest)
+		}
+	}
+	return q, nil
+}
+
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	target := workers.TargetAddr(r.PathValue("addr"))
+	q, err := parseHistoryQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	worker, err := workersCollection.Get(target)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	handled(r, "history", target)
+	writeJson(w, http.StatusOK, mqtt.HistoryResponse{
+		Target:      target,
+		Transitions: worker.History(q),
+	})
+}
+
+func pauseTarget(w http.ResponseWriter, r *http.Request) {
+	target := workers.TargetAddr(r.PathValue("addr"))
+	worker, err := workersCollection.Pause(target)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	handled(r, "pause", target)
+	writeJson(w, http.StatusOK, worker.Info())
+}
+
+func resumeTarget(w http.ResponseWriter, r *http.Request) {
+	target := workers.TargetAddr(r.PathValue("addr"))
+	worker, err := workersCollection.Resume(target)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	handled(r, "resume", target)
+	writeJson(w, http.StatusOK, worker.Info())
+}
+
+func getLog(w http.ResponseWriter, r *http.Request) {
+	hq, err := parseHistoryQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// whole table is never returned at once, use export for bulk reads
+	if hq.Limit == 0 {
+		hq.Limit = LOG_DEFAULT_LIMIT
+	}
+	hq.Limit = min(hq.Limit, LOG_MAX_LIMIT)
+	target := workers.TargetAddr(r.URL.Query().Get("target"))
+	events, err := storage.Events(storage.EventsQuery{
+		Target: target,
+		From:   hq.From,
+		To:     hq.To,
+		Limit:  hq.Limit,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	handled(r, "log", target)
+	writeJson(w, http.StatusOK, events)
+}
+
+func getDaily(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := storage.DailyQuery{
+		Target: workers.TargetAddr(params.Get("target")),
+		From:   params.Get("from"),
+		To:     params.Get("to"),
+	}
+	for _, day := range []string{q.From, q.To} {
+		if day == "" {
+			continue
+		}
+		if _, err := time.Parse(storage.DAY_FORMAT, day); err != nil {
+			writeError(w, fmt.Errorf("%w: day should be in YYYY-MM-DD format, got %q", errBadRequest, day))
+			return
+		}
+	}
+	rows, err := storage.DailyRollups(q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	handled(r, "daily", q.Target)
+	writeJson(w, http.StatusOK, rows)
+}
+
+// response is streamed, so error in the middle of export could only be logged
+func exportEvents(w http.ResponseWriter, r *http.Request) {
+	hq, err := parseHistoryQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = storage.FORMAT_CSV
+	}
+	if err := storage.CheckFormat(format); err != nil {
+		writeError(w, err)
+		return
+	}
+	kind := params.Get("kind")
+	if kind == "" {
+		kind = storage.KIND_EVENTS
+	}
+	if err := storage.CheckKind(kind); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !storage.Enabled() {
+		writeError(w, storage.ErrDisabled)
+		return
+	}
+	q := storage.ExportQuery{Kind: kind, From: hq.From, To: hq.To}
+	for _, t := range params["target"] {
+		q.Targets = append(q.Targets, workers.TargetAddr(t))
+	}
+	handled(r, "export", "")
+	w.Header().Set("Content-Type", storage.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="device-pinger-%s.%s"`, kind, format))
+	count, err := storage.Export(w, format, q)
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Export failed"), "written", count, "err", err)
+		return
+	}
+	slog.Debug(tagBase.F("Exported"), "count", count, "kind", kind, "format", format)
+}
+
+func getStats(w http.ResponseWriter, r *http.Request) {
+	handled(r, "get-stats", "")
+	writeJson(w, http.StatusOK, mqtt.GetStats())
+}
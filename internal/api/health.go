@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/mqtt"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+type HealthResponse struct {
+	Ok      bool                 `json:"ok"`
+	Reason  string               `json:"reason,omitempty"`
+	Stalled []workers.TargetAddr `json:"stalled,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Ok             bool   `json:"ok"`
+	Reason         string `json:"reason,omitempty"`
+	MqttConnected  bool   `json:"mqttConnected"`
+	MqttSubscribed bool   `json:"mqttSubscribed"`
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, rsp any) {
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusServiceUnavailable
+	}
+	writeJson(w, code, rsp)
+}
+
+// max age of the last online checker tick accepted by liveness probe, PINGER_LIVENESS_MISSED_TICKS intervals,
+// but never shorter than watchdog recovery window plus one more tick of the rebuilt worker,
+// so that container is not restarted before watchdog had a chance to recover stalled worker in-process
+func livenessMaxAge() time.Duration {
+	maxAge := registry.Config.OfflineCheckInterval * time.Duration(registry.Config.LivenessMissedTicks)
+	if window := workers.RecoveryWindow(); window > 0 {
+		maxAge = max(maxAge, window+registry.Config.OfflineCheckInterval)
+	}
+	return maxAge
+}
+
+// liveness fails when online checker of some worker has not ticked for several intervals,
+// which means worker goroutines are wedged and only restart could help
+func liveness(w http.ResponseWriter, r *http.Request) {
+	maxAge := livenessMaxAge()
+	rsp := HealthResponse{
+		Ok:      true,
+		Stalled: workersCollection.Stalled(maxAge),
+	}
+	if len(rsp.Stalled) > 0 {
+		rsp.Ok = false
+		rsp.Reason = "no online checker ticks for " + maxAge.String()
+	}
+	writeHealth(w, rsp.Ok, rsp)
+}
+
+// readiness fails while mqtt client is disconnected or api subscriptions are not settled
+func readiness(w http.ResponseWriter, r *http.Request) {
+	rsp := ReadinessResponse{
+		MqttConnected:  mqtt.IsConnected(),
+		MqttSubscribed: mqtt.IsSubscribed(),
+	}
+	switch {
+	case !rsp.MqttConnected:
+		rsp.Reason = "mqtt client is disconnected"
+	case !rsp.MqttSubscribed:
+		rsp.Reason = "mqtt subscriptions are not settled"
+	default:
+		rsp.Ok = true
+	}
+	writeHealth(w, rsp.Ok, rsp)
+}
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/fedulovivan/device-pinger/internal/mqtt"
+	"github.com/fedulovivan/device-pinger/internal/schema"
+	"github.com/fedulovivan/device-pinger/internal/storage"
+	"github.com/fedulovivan/device-pinger/internal/summary"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+// openapi document for the http api and standalone json schemas for all http and mqtt payloads,
+// both are generated from the go types on first request
+
+const OPENAPI_VERSION = "3.1.0"
+
+var (
+	schemasOnce sync.Once
+	schemas     map[string]*schema.Schema
+	openapiDoc  map[string]any
+)
+
+func buildSchemas() {
+	schemas = mqtt.Schemas()
+	schemas["TargetInfo"] = schema.For(workers.TargetInfo{})
+	schemas["StatusEvent"] = schema.For(workers.StatusEvent{})
+	schemas["CreateRequest"] = schema.For(CreateRequest{})
+	schemas["PatchRequest"] = schema.For(PatchRequest{})
+	schemas["Response"] = schema.For(Response{})
+	schemas["HealthResponse"] = schema.For(HealthResponse{})
+	schemas["ReadinessResponse"] = schema.For(ReadinessResponse{})
+	schemas["Report"] = schema.For(workers.Report{})
+	schemas["Summary"] = schema.For(summary.Summary{})
+	schemas["LogEvent"] = schema.For(storage.Event{})
+	schemas["LogSample"] = schema.For(storage.Sample{})
+	schemas["DailyRollup"] = schema.For(storage.Daily{})
+	openapiDoc = buildOpenapi()
+}
+
+func ref(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(s any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": s}}
+}
+
+func reply(description string, s any) map[string]any {
+	return map[string]any{"description": description, "content": jsonContent(s)}
+}
+
+func errorReply(description string) map[string]any {
+	return reply(description, ref("Response"))
+}
+
+func operation(summary string, protected bool, responses map[string]any) map[string]any {
+	op := map[string]any{"summary": summary, "responses": responses}
+	if !protected {
+		// override global security requirement
+		op["security"] = []any{}
+	}
+	return op
+}
+
+var addrParam = []any{map[string]any{
+	"name":     "addr",
+	"in":       "path",
+	"required": true,
+	"schema":   map[string]any{"type": "string"},
+}}
+
+func buildOpenapi() map[string]any {
+	authErrors := map[string]any{
+		"401": errorReply("Api token is missing"),
+		"403": errorReply("Api token is invalid"),
+	}
+	with := func(responses map[string]any) map[string]any {
+		for k, v := range authErrors {
+			responses[k] = v
+		}
+		return responses
+	}
+	targetsList := map[string]any{"type": "array", "items": ref("TargetInfo")}
+	list := operation("List targets", true, with(map[string]any{"200": reply("Targets", targetsList)}))
+	create := operation("Add target", true, with(map[string]any{
+		"201": reply("Created target", ref("TargetInfo")),
+		"400": errorReply("Invalid request body"),
+		"409": errorReply("Target already exists"),
+		"413": errorReply("Request body is larger than 64 KiB"),
+	}))
+	create["requestBody"] = map[string]any{"required": true, "content": jsonContent(ref("CreateRequest"))}
+	get := operation("Get target with availability report", true, with(map[string]any{
+		"200": reply("Target", ref("TargetInfo")),
+		"404": errorReply("Target does not exist"),
+	}))
+	get["parameters"] = addrParam
+	patch := operation("Update target name and labels", true, with(map[string]any{
+		"200": reply("Updated target", ref("TargetInfo")),
+		"400": errorReply("Invalid request body"),
+		"404": errorReply("Target does not exist"),
+		"413": errorReply("Request body is larger than 64 KiB"),
+	}))
+	patch["parameters"] = addrParam
+	patch["requestBody"] = map[string]any{"required": true, "content": jsonContent(ref("PatchRequest"))}
+	del := operation("Delete target", true, with(map[string]any{
+		"200": reply("Deleted", ref("Response")),
+		"404": errorReply("Target does not exist"),
+	}))
+	del["parameters"] = addrParam
+	history := operation("Status transitions of target", true, with(map[string]any{
+		"200": reply("Transitions from oldest to newest", ref("HistoryResponse")),
+		"400": errorReply("Invalid query params"),
+		"404": errorReply("Target does not exist"),
+	}))
+	history["parameters"] = append([]any{
+		map[string]any{"name": "from", "in": "query", "schema": map[string]any{"type": "string", "format": "date-time"}},
+		map[string]any{"name": "to", "in": "query", "schema": map[string]any{"type": "string", "format": "date-time"}},
+		map[string]any{"name": "limit", "in": "query", "description": "most recent entries", "schema": map[string]any{"type": "integer"}},
+	}, addrParam...)
+	report := operation("Availability report of target over 1h, 24h, 7d and 30d windows", true, with(map[string]any{
+		"200": reply("Report", ref("Report")),
+		"404": errorReply("Target does not exist"),
+	}))
+	report["parameters"] = addrParam
+	pause := operation("Pause monitoring of target", true, with(map[string]any{
+		"200": reply("Paused target", ref("TargetInfo")),
+		"404": errorReply("Target does not exist"),
+		"409": errorReply("Target is already paused"),
+	}))
+	pause["parameters"] = addrParam
+	resume := operation("Resume monitoring of paused target", true, with(map[string]any{
+		"200": reply("Resumed target", ref("TargetInfo")),
+		"404": errorReply("Target does not exist"),
+		"409": errorReply("Target is not paused"),
+	}))
+	resume["parameters"] = addrParam
+	targetParam := map[string]any{"name": "target", "in": "query", "schema": map[string]any{"type": "string"}}
+	logOp := operation("Durable event log", true, with(map[string]any{
+		"200": reply("Events from oldest to newest", map[string]any{"type": "array", "items": ref("LogEvent")}),
+		"400": errorReply("Invalid query params"),
+		"503": errorReply("Storage is disabled"),
+	}))
+	logOp["parameters"] = []any{
+		targetParam,
+		map[string]any{"name": "from", "in": "query", "schema": map[string]any{"type": "string", "format": "date-time"}},
+		map[string]any{"name": "to", "in": "query", "schema": map[string]any{"type": "string", "format": "date-time"}},
+		map[string]any{"name": "limit", "in": "query", "description": "most recent entries, 1000 by default, at most 10000", "schema": map[string]any{"type": "integer", "default": LOG_DEFAULT_LIMIT, "maximum": LOG_MAX_LIMIT}},
+	}
+	daily := operation("Daily per-target rollups", true, with(map[string]any{
+		"200": reply("Rollups ordered by day and target", map[string]any{"type": "array", "items": ref("DailyRollup")}),
+		"400": errorReply("Invalid query params"),
+		"503": errorReply("Storage is disabled"),
+	}))
+	daily["parameters"] = []any{
+		targetParam,
+		map[string]any{"name": "from", "in": "query", "description": "first day, inclusive", "schema": map[string]any{"type": "string", "format": "date"}},
+		map[string]any{"name": "to", "in": "query", "description": "last day, inclusive", "schema": map[string]any{"type": "string", "format": "date"}},
+	}
+	export := operation("Streaming export of the event log or ping samples", true, with(map[string]any{
+		"200": map[string]any{
+			"description": "Events or samples from oldest to newest, csv with header row or json lines with LogEvent (LogSample) per line",
+			"content": map[string]any{
+				"text/csv":             map[string]any{"schema": map[string]any{"type": "string"}},
+				"application/x-ndjson": map[string]any{"schema": map[string]any{"type": "string"}},
+			},
+		},
+		"400": errorReply("Invalid query params"),
+		"503": errorReply("Storage is disabled"),
+	}))
+	export["parameters"] = []any{
+		map[string]any{"name": "format", "in": "query", "schema": map[string]any{"type": "string", "enum": []any{storage.FORMAT_CSV, storage.FORMAT_JSONL}}},
+		map[string]any{"name": "kind", "in": "query", "description": "samples are recorded only with PINGER_DB_SAMPLES", "schema": map[string]any{"type": "string", "enum": []any{storage.KIND_EVENTS, storage.KIND_SAMPLES}}},
+		map[string]any{"name": "target", "in": "query", "description": "repeatable, all targets when omitted", "schema": map[string]any{"type": "string"}},
+		map[string]any{"name": "from", "in": "query", "schema": map[string]any{"type": "string", "format": "date-time"}},
+		map[string]any{"name": "to", "in": "query", "schema": map[string]any{"type": "string", "format": "date-time"}},
+	}
+	events := operation("Server-sent events stream of status changes", true, with(map[string]any{
+		"200": map[string]any{
+			"description": "Stream of status events, data of each event is StatusEvent json",
+			"content": map[string]any{"text/event-stream": map[string]any{
+				"schema": map[string]any{"type": "string"},
+			}},
+		},
+	}))
+	events["parameters"] = []any{
+		map[string]any{"name": "target", "in": "query", "schema": map[string]any{"type": "string"}},
+		map[string]any{"name": "name", "in": "query", "schema": map[string]any{"type": "string"}},
+		map[string]any{"name": "label", "in": "query", "description": "key=value", "schema": map[string]any{"type": "string"}},
+	}
+	components := map[string]any{}
+	for name, s := range schemas {
+		components[name] = s
+	}
+	return map[string]any{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]any{
+			"title":   "device-pinger",
+			"version": "1",
+		},
+		"security": []any{map[string]any{"bearer": []any{}}},
+		"paths": map[string]any{
+			"/targets": map[string]any{"get": list, "post": create},
+			"/targets/{addr}": map[string]any{
+				"get":    get,
+				"patch":  patch,
+				"delete": del,
+			},
+			"/targets/{addr}/history": map[string]any{"get": history},
+			"/targets/{addr}/report":  map[string]any{"get": report},
+			"/targets/{addr}/pause":   map[string]any{"post": pause},
+			"/targets/{addr}/resume":  map[string]any{"post": resume},
+			"/stats": map[string]any{
+				"get": operation("Application stats", true, with(map[string]any{"200": reply("Stats", ref("StatsResponse"))})),
+			},
+			"/events": map[string]any{"get": events},
+			"/log":    map[string]any{"get": logOp},
+			"/daily":  map[string]any{"get": daily},
+			"/export": map[string]any{"get": export},
+			"/healthz": map[string]any{
+				"get": operation("Liveness probe", false, map[string]any{
+					"200": reply("Alive", ref("HealthResponse")),
+					"503": reply("Some workers are stalled", ref("HealthResponse")),
+				}),
+			},
+			"/readyz": map[string]any{
+				"get": operation("Readiness probe", false, map[string]any{
+					"200": reply("Ready", ref("ReadinessResponse")),
+					"503": reply("Mqtt is not connected or subscribed", ref("ReadinessResponse")),
+				}),
+			},
+		},
+		"components": map[string]any{
+			"schemas": components,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func getOpenapi(w http.ResponseWriter, r *http.Request) {
+	schemasOnce.Do(buildSchemas)
+	writeJson(w, http.StatusOK, openapiDoc)
+}
+
+func listSchemas(w http.ResponseWriter, r *http.Request) {
+	schemasOnce.Do(buildSchemas)
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeJson(w, http.StatusOK, names)
+}
+
+func getSchema(w http.ResponseWriter, r *http.Request) {
+	schemasOnce.Do(buildSchemas)
+	name := r.PathValue("name")
+	s, ok := schemas[name]
+	if !ok {
+		writeJson(w, http.StatusNotFound, Response{Message: fmt.Sprintf("schema %s does not exist", name), IsError: true})
+		return
+	}
+	writeJson(w, http.StatusOK, schema.Document("/schemas/"+name, s))
+}
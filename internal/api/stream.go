@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+// server-sent events stream of status changes and periodic updates,
+// each client first receives snapshot of the current state and then live deltas.
+// client, which is too slow to consume deltas, is disconnected instead of silently missing them,
+// so it reconnects (EventSource does it automatically) and resyncs from a fresh snapshot
+
+const (
+	STREAM_BUFFER     = 64
+	STREAM_KEEP_ALIVE = 30 * time.Second
+)
+
+type streamFilter struct {
+	targets map[workers.TargetAddr]bool
+	names   map[string]bool
+	labels  map[string]string
+}
+
+type streamClient struct {
+	events chan workers.StatusEvent
+	filter streamFilter
+	// closed when client is evicted because its buffer is full
+	evicted chan struct{}
+}
+
+var (
+	clientsMu sync.Mutex
+	clients   = map[*streamClient]struct{}{}
+)
+
+// parse ?target=<ip>&name=<name>&label=<key>=<value>, each param could be repeated,
+// event should match any of the given targets and names, and all of the given labels
+func parseStreamFilter(r *http.Request) streamFilter {
+	q := r.URL.Query()
+	f := streamFilter{
+		targets: map[workers.TargetAddr]bool{},
+		names:   map[string]bool{},
+		labels:  map[string]string{},
+	}
+	for _, t := range q["target"] {
+		f.targets[workers.TargetAddr(t)] = true
+	}
+	for _, n := range q["name"] {
+		f.names[n] = true
+	}
+	for _, l := range q["label"] {
+		k, v, _ := strings.Cut(l, "=")
+		f.labels[k] = v
+	}
+	return f
+}
+
+func (f streamFilter) match(e workers.StatusEvent) bool {
+	if len(f.targets) > 0 && !f.targets[e.Target] {
+		return false
+	}
+	if len(f.names) > 0 && !f.names[e.Name] {
+		return false
+	}
+	for k, v := range f.labels {
+		if e.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// status change sink, never blocks the bus,
+// clients which are too slow to consume events are evicted
+var SendStatus workers.OnlineStatusChangeHandler = func(event workers.StatusEvent) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for c := range clients {
+		if !c.filter.match(event) {
+			continue
+		}
+		select {
+		case c.events <- event:
+		default:
+			counters.StreamDropped.Inc()
+			evict_unsafe(c)
+		}
+	}
+}
+
+// client stops receiving events, stream handler closes the connection
+func evict_unsafe(c *streamClient) {
+	delete(clients, c)
+	close(c.evicted)
+	counters.StreamEvicted.Inc()
+	counters.StreamClients.Set(float64(len(clients)))
+}
+
+func subscribe(f streamFilter) *streamClient {
+	c := &streamClient{
+		events:  make(chan workers.StatusEvent, STREAM_BUFFER),
+		filter:  f,
+		evicted: make(chan struct{}),
+	}
+	clientsMu.Lock()
+	clients[c] = struct{}{}
+	counters.StreamClients.Set(float64(len(clients)))
+	clientsMu.Unlock()
+	return c
+}
+
+func unsubscribe(c *streamClient) {
+	clientsMu.Lock()
+	delete(clients, c)
+	counters.StreamClients.Set(float64(len(clients)))
+	clientsMu.Unlock()
+}
+
+func writeEvent(w http.ResponseWriter, name string, event workers.StatusEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
+
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	f := parseStreamFilter(r)
+
+	// subscribe before taking snapshot, so no deltas are lost in between
+	c := subscribe(f)
+	defer unsubscribe(c)
+	slog.Debug(tagBase.F("Stream client connected"), "remote", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, worker := range workersCollection.List() {
+		event := worker.Event(workers.UPD_SOURCE_SNAPSHOT)
+		if !f.match(event) {
+			continue
+		}
+		if err := writeEvent(w, "snapshot", event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(STREAM_KEEP_ALIVE)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.Debug(tagBase.F("Stream client disconnected"), "remote", r.RemoteAddr)
+			return
+		case <-c.evicted:
+			slog.Warn(tagBase.F("Stream client is too slow, disconnecting"), "remote", r.RemoteAddr, "buffer", STREAM_BUFFER)
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event := <-c.events:
+			if err := writeEvent(w, "status", event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+func TestSlowClientIsEvicted(t *testing.T) {
+	slow := subscribe(parseStreamFilter(httptest.NewRequest("GET", "/events", nil)))
+	defer unsubscribe(slow)
+	other := subscribe(parseStreamFilter(httptest.NewRequest("GET", "/events?target=10.0.0.2", nil)))
+	defer unsubscribe(other)
+	for i := 0; i <= STREAM_BUFFER; i++ {
+		SendStatus(workers.StatusEvent{Target: "10.0.0.1", Status: workers.STATUS_ONLINE})
+	}
+	select {
+	case <-slow.evicted:
+	default:
+		t.Fatalf("slow client is not evicted")
+	}
+	select {
+	case <-other.evicted:
+		t.Fatalf("client which did not receive events is evicted")
+	default:
+	}
+	// evicted client gets nothing more
+	SendStatus(workers.StatusEvent{Target: "10.0.0.1", Status: workers.STATUS_OFFLINE})
+	if n := len(slow.events); n != STREAM_BUFFER {
+		t.Errorf("evicted client has %d events, expected %d", n, STREAM_BUFFER)
+	}
+}
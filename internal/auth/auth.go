@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+)
+
+// http api is protected with static bearer tokens from PINGER_API_TOKENS,
+// mqtt actions, which are not in PINGER_MQTT_PUBLIC_ACTIONS allow-list, require either
+// shared secret or hmac signature in request payload, when PINGER_MQTT_SECRET is set
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// payload field, which carries the signature and is excluded from the signed content
+const SIGNATURE_FIELD = "sig"
+
+// mqtt/homie request credentials
+type Credentials struct {
+	Secret    string
+	Signature string
+	Ts        int64
+	Seq       int
+	// raw json object or array of the request, signature covers all of its fields except sig
+	Payload []byte
+}
+
+// action/target/seq/ts keys of accepted signatures with their expiration time, key is kept
+// while its timestamp is within PINGER_MQTT_SIGNATURE_MAX_AGE, so the same request cannot be replayed,
+// while requests of other actions or targets with the same seq/ts are not affected
+var (
+	seenLock sync.Mutex
+	seen     = map[string]time.Time{}
+)
+
+func Reject(iface string, action string) {
+	counters.CommandsRejected.WithLabelValues(iface, action).Inc()
+}
+
+func IsPublic(action string) bool {
+	return registry.Config.MqttSecret == "" || slices.Contains(registry.Config.MqttPublicActions, action)
+}
+
+// compact json with sorted keys and without top level sig field, same as `jq -cS 'del(.sig)'` produces,
+// payload is either object or array (like add-many/del-many list), array has no sig field to remove
+func Canonical(payload []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	// numbers are kept as they were sent, without float conversion
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		delete(v, SIGNATURE_FIELD)
+	case []any:
+	default:
+		return nil, fmt.Errorf("expected json object or array")
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// hex encoded hmac-sha256 of "<action>/<target>/<canonical payload>" with PINGER_MQTT_SECRET as a key
+func Sign(secret string, action string, target string, canonical []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s/%s/", action, target)
+	mac.Write(canonical)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// remember key of accepted signature, false when it was already used
+func remember(action string, target string, seq int, ts int64) bool {
+	seenLock.Lock()
+	defer seenLock.Unlock()
+	now := time.Now()
+	for key, expires := range seen {
+		if now.After(expires) {
+			delete(seen, key)
+		}
+	}
+	key := fmt.Sprintf("%s/%s/%d/%d", action, target, seq, ts)
+	if _, ok := seen[key]; ok {
+		return false
+	}
+	seen[key] = time.Unix(ts, 0).Add(registry.Config.MqttSignatureMaxAge)
+	return true
+}
+
+// check whether mqtt action is allowed for the given credentials
+func CheckAction(action string, target string, creds Credentials) error {
+	if IsPublic(action) {
+		return nil
+	}
+	secret := registry.Config.MqttSecret
+	if creds.Secret != "" {
+		if subtle.ConstantTimeCompare([]byte(creds.Secret), []byte(secret)) == 1 {
+			return nil
+		}
+		return fmt.Errorf("%w: invalid secret for %s", ErrForbidden, action)
+	}
+	if creds.Signature != "" {
+		age := time.Since(time.Unix(creds.Ts, 0)).Abs()
+		if age > registry.Config.MqttSignatureMaxAge {
+			return fmt.Errorf("%w: signature timestamp is off by %v", ErrForbidden, age.Round(time.Second))
+		}
+		canonical, err := Canonical(creds.Payload)
+		if err != nil {
+			return fmt.Errorf("%w: cannot verify signature: %w", ErrForbidden, err)
+		}
+		expected := Sign(secret, action, target, canonical)
+		if !hmac.Equal([]byte(strings.ToLower(creds.Signature)), []byte(expected)) {
+			return fmt.Errorf("%w: invalid signature for %s", ErrForbidden, action)
+		}
+		if !remember(action, target, creds.Seq, creds.Ts) {
+			return fmt.Errorf("%w: signature with seq %d and ts %d was already used", ErrForbidden, creds.Seq, creds.Ts)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s requires secret or signature", ErrUnauthorized, action)
+}
+
+// check bearer token from Authorization header, token is never accepted in query string,
+// since urls end up in access logs of proxies
+func CheckToken(r *http.Request) error {
+	tokens := registry.Config.ApiTokens
+	if len(tokens) == 0 {
+		return nil
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return fmt.Errorf("%w: api token is required", ErrUnauthorized)
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: invalid api token", ErrForbidden)
+}
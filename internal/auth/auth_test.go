@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/registry"
+)
+
+func TestCanonical(t *testing.T) {
+	payload := `{"ts": 1700000000, "seq": 7, "name": "a<b>&ü", "labels": {"z":"1","a":"2"}, "targets":["10.0.0.1",{"target":"10.0.0.2"}], "sig":"x"}`
+	// output of `jq -cS 'del(.sig)'` for the same payload
+	expected := `{"labels":{"a":"2","z":"1"},"name":"a<b>&ü","seq":7,"targets":["10.0.0.1",{"target":"10.0.0.2"}],"ts":1700000000}`
+	res, err := Canonical([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != expected {
+		t.Errorf("got %s, expected %s", res, expected)
+	}
+}
+
+func TestCanonicalArray(t *testing.T) {
+	payload := `[ "10.0.0.1", {"target":"10.0.0.2", "name":"b", "labels":{"z":"1","a":"2"}} ]`
+	expected := `["10.0.0.1",{"labels":{"a":"2","z":"1"},"name":"b","target":"10.0.0.2"}]`
+	res, err := Canonical([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != expected {
+		t.Errorf("got %s, expected %s", res, expected)
+	}
+	if _, err := Canonical([]byte(`"10.0.0.1"`)); err == nil {
+		t.Errorf("expected error for json string")
+	}
+}
+
+func signed(t *testing.T, secret string, action string, target string, body string) Credentials {
+	t.Helper()
+	canonical, err := Canonical([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Credentials{Signature: Sign(secret, action, target, canonical), Payload: []byte(body)}
+}
+
+func TestCheckActionSignature(t *testing.T) {
+	registry.Config.MqttSecret = "secret"
+	registry.Config.MqttPublicActions = []string{"get"}
+	registry.Config.MqttSignatureMaxAge = time.Minute
+	ts := time.Now().Unix()
+	body := func(seq int, name string) string {
+		return fmt.Sprintf(`{"seq":%d,"ts":%d,"name":%q}`, seq, ts, name)
+	}
+
+	creds := signed(t, "secret", "add", "10.0.0.1", body(1, "phone"))
+	creds.Seq, creds.Ts = 1, ts
+	if err := CheckAction("add", "10.0.0.1", creds); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if err := CheckAction("add", "10.0.0.1", creds); !errors.Is(err, ErrForbidden) {
+		t.Errorf("replay accepted: %v", err)
+	}
+
+	// same seq/ts of the other action or target is not a replay
+	creds = signed(t, "secret", "add", "10.0.0.2", body(1, "phone"))
+	creds.Seq, creds.Ts = 1, ts
+	if err := CheckAction("add", "10.0.0.2", creds); err != nil {
+		t.Errorf("same seq/ts for other target rejected: %v", err)
+	}
+	creds = signed(t, "secret", "pause", "10.0.0.1", body(1, "phone"))
+	creds.Seq, creds.Ts = 1, ts
+	if err := CheckAction("pause", "10.0.0.1", creds); err != nil {
+		t.Errorf("same seq/ts for other action rejected: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		target string
+		creds  Credentials
+		body   string
+	}{
+		{"tampered payload", "10.0.0.1", signed(t, "secret", "add", "10.0.0.1", body(2, "phone")), body(2, "laptop")},
+		{"other target", "10.0.0.2", signed(t, "secret", "add", "10.0.0.1", body(3, "phone")), body(3, "phone")},
+		{"wrong secret", "10.0.0.1", signed(t, "other", "add", "10.0.0.1", body(4, "phone")), body(4, "phone")},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.creds.Seq, c.creds.Ts, c.creds.Payload = i+2, ts, []byte(c.body)
+			if err := CheckAction("add", c.target, c.creds); !errors.Is(err, ErrForbidden) {
+				t.Errorf("expected forbidden, got %v", err)
+			}
+		})
+	}
+
+	old := time.Now().Add(-2 * time.Minute).Unix()
+	oldBody := fmt.Sprintf(`{"seq":9,"ts":%d}`, old)
+	creds = signed(t, "secret", "del", "10.0.0.1", oldBody)
+	creds.Seq, creds.Ts = 9, old
+	if err := CheckAction("del", "10.0.0.1", creds); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expired signature accepted: %v", err)
+	}
+
+	if err := CheckAction("get", "10.0.0.1", Credentials{}); err != nil {
+		t.Errorf("public action rejected: %v", err)
+	}
+	if err := CheckAction("del", "10.0.0.1", Credentials{}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	registry.Config.ApiTokens = []string{"token"}
+	defer func() { registry.Config.ApiTokens = nil }()
+
+	r := httptest.NewRequest("GET", "/targets", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	if err := CheckToken(r); err != nil {
+		t.Errorf("valid token rejected: %v", err)
+	}
+	r = httptest.NewRequest("GET", "/events?token=token", nil)
+	if err := CheckToken(r); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("query token should not be accepted, got %v", err)
+	}
+	r = httptest.NewRequest("GET", "/targets", nil)
+	r.Header.Set("Authorization", "Bearer other")
+	if err := CheckToken(r); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected forbidden, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package bus
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/logger"
+	"github.com/fedulovivan/mhz19-go/pkg/utils"
+)
+
+// in-process fan-out of events to any number of independent sinks,
+// every sink has its own buffer and goroutine, so publisher is never blocked
+// and slow sink does not delay the others. events which do not fit into the buffer
+// of a sink are dropped for that sink only and counted in pinger_bus_dropped metric.
+// each sink receives events in the order they were published.
+
+var tagBase = utils.NewTag(logger.TAG_BUS)
+
+type subscription[T any] struct {
+	name    string
+	events  chan T
+	handler func(T)
+}
+
+type Bus[T any] struct {
+	mu     sync.RWMutex
+	subs   []*subscription[T]
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func New[T any]() *Bus[T] {
+	return &Bus[T]{}
+}
+
+// register sink with dedicated buffer of given size, name is used in logs and metrics,
+// sinks added after Close are ignored
+func (b *Bus[T]) Subscribe(name string, buffer int, handler func(T)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	s := &subscription[T]{
+		name:    name,
+		events:  make(chan T, buffer),
+		handler: handler,
+	}
+	b.subs = append(b.subs, s)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for event := range s.events {
+			s.handler(event)
+		}
+	}()
+	slog.Debug(tagBase.F("Sink subscribed"), "name", name, "buffer", buffer)
+}
+
+// never blocks
+func (b *Bus[T]) Publish(event T) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return
+	}
+	for _, s := range b.subs {
+		select {
+		case s.events <- event:
+		default:
+			counters.BusDropped.WithLabelValues(s.name).Inc()
+			slog.Warn(tagBase.F("Sink buffer is full, event dropped"), "name", s.name)
+		}
+	}
+}
+
+// stop accepting events and wait until sinks handle the buffered ones
+func (b *Bus[T]) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	for _, s := range b.subs {
+		close(s.events)
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
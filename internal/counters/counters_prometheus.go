@@ -44,6 +44,150 @@ var MqttPublished = promauto.NewCounter(
 	},
 )
 
+var MqttTimeouts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pinger_mqtt_timeouts",
+	},
+	[]string{"op"},
+)
+
+var StreamDropped = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pinger_stream_dropped",
+	},
+)
+
+var StreamEvicted = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pinger_stream_evicted",
+	},
+)
+
+var StreamClients = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "pinger_stream_clients",
+	},
+)
+
+var WatchdogRecoveries = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pinger_watchdog_recoveries",
+	},
+	[]string{"target", "reason"},
+)
+
+var CommandsRejected = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pinger_commands_rejected",
+	},
+	[]string{"interface", "action"},
+)
+
+var PayloadsRejected = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pinger_payloads_rejected",
+	},
+	[]string{"action"},
+)
+
+var StorageWritten = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pinger_storage_written",
+	},
+)
+
+var StorageDropped = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pinger_storage_dropped",
+	},
+)
+
+var Availability = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pinger_availability_percent",
+	},
+	[]string{"target", "window"},
+)
+
+var Outages = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pinger_outages",
+	},
+	[]string{"target", "window"},
+)
+
+var OutageSeconds = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pinger_outage_seconds",
+	},
+	[]string{"target", "window"},
+)
+
+var Mtbf = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pinger_mtbf_seconds",
+	},
+	[]string{"target", "window"},
+)
+
+var Mttr = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pinger_mttr_seconds",
+	},
+	[]string{"target", "window"},
+)
+
+var WebhookDelivered = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pinger_webhook_delivered",
+	},
+	[]string{"url"},
+)
+
+var WebhookDeadLetters = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pinger_webhook_dead_letters",
+	},
+	[]string{"url"},
+)
+
+var BusDropped = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pinger_bus_dropped",
+	},
+	[]string{"sink"},
+)
+
+var JsonlDropped = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pinger_jsonl_dropped",
+	},
+)
+
+var SyslogSent = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pinger_syslog_sent",
+	},
+)
+
+var SyslogDropped = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pinger_syslog_dropped",
+	},
+)
+
+var InfluxWritten = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pinger_influx_written",
+	},
+)
+
+var InfluxDropped = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pinger_influx_dropped",
+	},
+)
+
 var Workers = promauto.NewGauge(
 	prometheus.GaugeOpts{
 		Name: "pinger_workers",
@@ -0,0 +1,316 @@
+package homie
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/auth"
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/logger"
+	"github.com/fedulovivan/device-pinger/internal/mqtt"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+	"github.com/fedulovivan/mhz19-go/pkg/utils"
+)
+
+// exposes device-pinger as a device following homie 4 convention https://homieiot.github.io/specification/spec-core-v4_0_0/
+// each target is represented by a node with status, last-seen, rtt and enabled properties (false means paused),
+// and dedicated "pinger" node accepts add/del commands
+
+const (
+	HOMIE_VERSION = "4.0"
+	CONTROL_NODE  = "pinger"
+	QOS           = 1
+)
+
+var tagBase = utils.NewTag(logger.TAG_HOMI)
+
+var notIdChars = regexp.MustCompile("[^a-z0-9-]+")
+
+var workersCollection *workers.Collection
+
+var (
+	nodesMu      sync.Mutex
+	nodes        = map[string]workers.TargetAddr{} // announced node id -> target
+	nodeIds      = map[workers.TargetAddr]string{} // assigned node id of the target, kept over reconnects
+	nodesChanged = make(chan struct{}, 1)
+)
+
+func deviceTopic(parts ...string) string {
+	return strings.Join(append([]string{registry.Config.HomieBase, registry.Config.HomieDeviceId}, parts...), "/")
+}
+
+// homie ids may contain only lowercase latin letters, digits and hyphens,
+// so "192.168.0.1" becomes "192-168-0-1"
+func NodeId(target workers.TargetAddr) string {
+	return strings.Trim(notIdChars.ReplaceAllString(strings.ToLower(string(target)), "-"), "-")
+}
+
+// different targets could map to the same id, like "192.168.0.1" and "192-168-0-1",
+// so the target coming later gets short hash suffix, e.g. "192-168-0-1-3f2a1c"
+func uniqueNodeId(target workers.TargetAddr, taken map[string]workers.TargetAddr) string {
+	id := NodeId(target)
+	if _, ok := taken[id]; !ok && id != "" && id != CONTROL_NODE {
+		return id
+	}
+	h := fnv.New32a()
+	h.Write([]byte(target))
+	return strings.TrimPrefix(fmt.Sprintf("%s-%06x", id, h.Sum32()&0xffffff), "-")
+}
+
+func publish(topic string, value string) {
+	err := mqtt.PublishRaw(topic, QOS, true, []byte(value))
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Error"), "err", err)
+	}
+}
+
+// should be called before mqtt.Connect() to register will message and connect hook
+func Init(wc *workers.Collection) {
+	workersCollection = wc
+	mqtt.SetWill(deviceTopic("$state"), "lost", QOS, true)
+	mqtt.OnConnect(onConnect)
+	go func() {
+		for range nodesChanged {
+			refreshNodes()
+		}
+	}()
+}
+
+// non-blocking, repeated notifications are coalesced into single nodes refresh
+func NotifyNodesChanged() {
+	select {
+	case nodesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// should be called before mqtt disconnect
+func Disconnect() {
+	publish(deviceTopic("$state"), "disconnected")
+}
+
+func onConnect() {
+	publish(deviceTopic("$state"), "init")
+	publish(deviceTopic("$homie"), HOMIE_VERSION)
+	publish(deviceTopic("$name"), registry.Config.HomieDeviceId)
+	// required by the convention, no extensions are supported
+	publish(deviceTopic("$extensions"), "")
+	for topic, value := range controlNodeAttributes() {
+		publish(topic, value)
+	}
+	// force all nodes to be announced again
+	nodesMu.Lock()
+	nodes = map[string]workers.TargetAddr{}
+	nodesMu.Unlock()
+	refreshNodes()
+	mqtt.Subscribe(deviceTopic("+", "+", "set"), onSet)
+	publish(deviceTopic("$state"), "ready")
+}
+
+func controlNodeAttributes() map[string]string {
+	return map[string]string{
+		deviceTopic(CONTROL_NODE, "$name"):            "Device pinger",
+		deviceTopic(CONTROL_NODE, "$type"):            "control",
+		deviceTopic(CONTROL_NODE, "$properties"):      "add,del",
+		deviceTopic(CONTROL_NODE, "add", "$name"):     "Add target",
+		deviceTopic(CONTROL_NODE, "add", "$datatype"): "string",
+		deviceTopic(CONTROL_NODE, "add", "$settable"): "true",
+		deviceTopic(CONTROL_NODE, "add", "$retained"): "false",
+		deviceTopic(CONTROL_NODE, "del", "$name"):     "Delete target",
+		deviceTopic(CONTROL_NODE, "del", "$datatype"): "string",
+		deviceTopic(CONTROL_NODE, "del", "$settable"): "true",
+		deviceTopic(CONTROL_NODE, "del", "$retained"): "false",
+	}
+}
+
+func targetNodeAttributes(id string, name string) map[string]string {
+	return map[string]string{
+		deviceTopic(id, "$name"):                  name,
+		deviceTopic(id, "$type"):                  "ping-target",
+		deviceTopic(id, "$properties"):            "status,last-seen,rtt,enabled",
+		deviceTopic(id, "status", "$name"):        "Status",
+		deviceTopic(id, "status", "$datatype"):    "enum",
+		deviceTopic(id, "status", "$format"):      "invalid,unknown,offline,online,paused,off-schedule,unreachable",
+		deviceTopic(id, "last-seen", "$name"):     "Last seen",
+		deviceTopic(id, "last-seen", "$datatype"): "datetime",
+		deviceTopic(id, "rtt", "$name"):           "Round-trip time",
+		deviceTopic(id, "rtt", "$datatype"):       "float",
+		deviceTopic(id, "rtt", "$unit"):           "ms",
+		deviceTopic(id, "enabled", "$name"):       "Enabled",
+		deviceTopic(id, "enabled", "$datatype"):   "boolean",
+		deviceTopic(id, "enabled", "$settable"):   "true",
+	}
+}
+
+func targetNodeValues(id string, event workers.StatusEvent) map[string]string {
+	lastSeen := ""
+	if !event.LastSeen.IsZero() {
+		lastSeen = event.LastSeen.Format(time.RFC3339)
+	}
+	return map[string]string{
+		deviceTopic(id, "status"):    event.StatusName(),
+		deviceTopic(id, "last-seen"): lastSeen,
+		deviceTopic(id, "rtt"):       fmt.Sprintf("%.3f", float64(event.Rtt.Microseconds())/1000),
+		deviceTopic(id, "enabled"):   strconv.FormatBool(event.Status != workers.STATUS_PAUSED),
+	}
+}
+
+// sync announced nodes with the workers collection,
+// targets keep ids assigned earlier, so id of the node does not change when colliding target is added
+func refreshNodes() {
+	list := workersCollection.List()
+	next := map[string]workers.TargetAddr{}
+	ids := map[workers.TargetAddr]string{}
+	nodesMu.Lock()
+	for _, worker := range list {
+		if id, ok := nodeIds[worker.Target()]; ok {
+			next[id] = worker.Target()
+			ids[worker.Target()] = id
+		}
+	}
+	for _, worker := range list {
+		if _, ok := ids[worker.Target()]; !ok {
+			id := uniqueNodeId(worker.Target(), next)
+			next[id] = worker.Target()
+			ids[worker.Target()] = id
+		}
+	}
+	prev := nodes
+	nodes = next
+	nodeIds = ids
+	nodesMu.Unlock()
+	for id, target := range prev {
+		if next[id] == target {
+			continue
+		}
+		// empty retained payload removes topic from the broker
+		for topic := range targetNodeAttributes(id, "") {
+			publish(topic, "")
+		}
+		for topic := range targetNodeValues(id, workers.StatusEvent{}) {
+			publish(topic, "")
+		}
+	}
+	for _, worker := range list {
+		id := ids[worker.Target()]
+		if prev[id] == worker.Target() {
+			continue
+		}
+		name := worker.Meta().Name
+		if name == "" {
+			name = string(worker.Target())
+		}
+		for topic, value := range targetNodeAttributes(id, name) {
+			publish(topic, value)
+		}
+		for topic, value := range targetNodeValues(id, worker.Event(workers.UPD_SOURCE_PERIODIC)) {
+			publish(topic, value)
+		}
+	}
+	sorted := make([]string, 0, len(next))
+	for id := range next {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+	publish(deviceTopic("$nodes"), strings.Join(append([]string{CONTROL_NODE}, sorted...), ","))
+}
+
+// status change handler, publishes property values of the target node
+var SendStatus workers.OnlineStatusChangeHandler = func(event workers.StatusEvent) {
+	if event.UpdSource == workers.UPD_SOURCE_WORKER_STOP {
+		// node is going to be removed
+		return
+	}
+	nodesMu.Lock()
+	id, announced := nodeIds[event.Target]
+	if announced {
+		_, announced = nodes[id]
+	}
+	nodesMu.Unlock()
+	if !announced {
+		// values will be published along with node announcement
+		NotifyNodesChanged()
+		return
+	}
+	for topic, value := range targetNodeValues(id, event) {
+		publish(topic, value)
+	}
+}
+
+func onSet(topic string, payload []byte) {
+	tt := strings.Split(topic, "/")
+	if len(tt) < 3 {
+		return
+	}
+	node, property, value := tt[len(tt)-3], tt[len(tt)-2], strings.TrimSpace(string(payload))
+	var (
+		action string
+		target workers.TargetAddr
+		err    error
+	)
+	if node == CONTROL_NODE {
+		action, target = property, workers.TargetAddr(value)
+		// homie set payload cannot carry credentials, so only public actions are allowed
+		if !auth.IsPublic(action) {
+			auth.Reject("homie", action)
+			slog.Error(tagBase.F("Action is not allowed without credentials"), "action", action)
+			return
+		}
+		switch property {
+		case "add":
+			_, err = workersCollection.Create(target, workers.Meta{})
+		case "del":
+			err = workersCollection.Delete(target)
+		default:
+			err = fmt.Errorf("unexpected property %s", property)
+		}
+	} else {
+		nodesMu.Lock()
+		t, ok := nodes[node]
+		nodesMu.Unlock()
+		target = t
+		switch {
+		case !ok:
+			err = fmt.Errorf("unknown node %s", node)
+		case property != "enabled":
+			err = fmt.Errorf("property %s is not settable", property)
+		case value == "false":
+			action = "pause"
+		case value == "true":
+			action = "resume"
+		default:
+			err = fmt.Errorf("unexpected boolean value %s", value)
+		}
+		if action != "" && !auth.IsPublic(action) {
+			auth.Reject("homie", action)
+			err = fmt.Errorf("%s is not allowed without credentials", action)
+		} else if action == "pause" {
+			_, err = workersCollection.Pause(target)
+		} else if action == "resume" {
+			_, err = workersCollection.Resume(target)
+		}
+		// setting the same value again is not an error
+		if errors.Is(err, workers.ErrAlreadyPaused) || errors.Is(err, workers.ErrNotPaused) {
+			err = nil
+		}
+	}
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to handle set"), "topic", topic, "err", err)
+		return
+	}
+	if action != "" {
+		slog.Info(tagBase.F("Handled set"), "action", action, "target", target)
+		counters.ActionsHandled.WithLabelValues("homie-"+action, string(target)).Inc()
+	}
+}
@@ -0,0 +1,301 @@
+package influx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/logger"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+	"github.com/fedulovivan/mhz19-go/pkg/utils"
+)
+
+// influx writer converts ping samples (every reply) and status events (transitions and periodic updates)
+// into line protocol points of device_ping measurement and writes them in batches either with http POST
+// to the configured write url (influxdb v1 /write or v2 /api/v2/write) or to udp listener.
+// batch is written when it reaches batch size or on flush interval, whatever comes first.
+// points of failed http write are kept and retried with the next batch, while buffer is limited
+// to MAX_BATCHES batches, the oldest points above it are dropped.
+
+const (
+	MEASUREMENT = "device_ping"
+	QUEUE_SIZE  = 1024
+	MAX_BATCHES = 10
+	// keeps datagram below typical mtu
+	MAX_DATAGRAM = 1400
+)
+
+var tagBase = utils.NewTag(logger.TAG_INFL)
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	tagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+)
+
+type Options struct {
+	Token         string
+	BatchSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+}
+
+type Writer struct {
+	url    *url.URL
+	opts   Options
+	client *http.Client
+	conn   net.Conn
+	queue  chan []byte
+	wg     sync.WaitGroup
+	// lines waiting to be written, accessed only from run goroutine
+	pending [][]byte
+}
+
+// point fields, zero or nil ones except status are omitted
+type fields struct {
+	status   workers.OnlineStatus
+	rtt      time.Duration
+	loss     *float64
+	lastSeen time.Time
+}
+
+// encode single point, tags are sorted by key as influxdb recommends,
+// labels become tags with the same keys, except reserved target and name
+func encode(target workers.TargetAddr, meta workers.Meta, f fields, ts time.Time) []byte {
+	tags := map[string]string{}
+	for k, v := range meta.Labels {
+		tags[k] = v
+	}
+	tags["target"] = string(target)
+	tags["name"] = meta.Name
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		// empty tag values are not allowed
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	b.WriteString(measurementEscaper.Replace(MEASUREMENT))
+	for _, k := range keys {
+		b.WriteString("," + tagEscaper.Replace(k) + "=" + tagEscaper.Replace(tags[k]))
+	}
+	b.WriteString(" status=" + strconv.Itoa(int(f.status)) + "i")
+	if f.rtt > 0 {
+		b.WriteString(",rtt_ms=" + strconv.FormatFloat(float64(f.rtt.Microseconds())/1000, 'f', -1, 64))
+	}
+	if f.loss != nil {
+		b.WriteString(",loss=" + strconv.FormatFloat(*f.loss, 'f', -1, 64))
+	}
+	if !f.lastSeen.IsZero() {
+		b.WriteString(",last_seen=" + strconv.FormatInt(f.lastSeen.UnixMilli(), 10) + "i")
+	}
+	b.WriteString(" " + strconv.FormatInt(ts.UnixNano(), 10) + "\n")
+	return b.Bytes()
+}
+
+func PingLine(s workers.PingSample) []byte {
+	return encode(s.Target, s.Meta, fields{status: s.Status, rtt: s.Rtt, loss: &s.Loss, lastSeen: s.LastSeen}, s.Ts)
+}
+
+func StatusLine(e workers.StatusEvent) []byte {
+	return encode(e.Target, e.Meta, fields{status: e.Status, rtt: e.Rtt, lastSeen: e.LastSeen}, e.Ts)
+}
+
+// create writer and start batching goroutine, nil client means http.DefaultClient
+func NewWriter(rawUrl string, opts Options, client *http.Client) (*Writer, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		url:    u,
+		opts:   opts,
+		client: client,
+		queue:  make(chan []byte, QUEUE_SIZE),
+	}
+	if w.client == nil {
+		w.client = http.DefaultClient
+	}
+	switch {
+	case (u.Scheme == "http" || u.Scheme == "https") && u.Host != "":
+	case u.Scheme == "udp" && u.Port() != "":
+		// udp socket is connected once, dial does not require listener to be up
+		if w.conn, err = net.Dial("udp", u.Host); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid influx url %q, expected http, https or udp url", rawUrl)
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// never blocks, point is dropped when queue is full
+func (w *Writer) Send(line []byte) {
+	select {
+	case w.queue <- line:
+	default:
+		counters.InfluxDropped.Inc()
+	}
+}
+
+// write queued points and stop, failed ones are not retried
+func (w *Writer) Close() {
+	close(w.queue)
+	w.wg.Wait()
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+}
+
+func (w *Writer) run() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-w.queue:
+			if !ok {
+				w.flush()
+				return
+			}
+			w.pending = append(w.pending, line)
+			// after failed write pending points are retried on tick or with the next full batch
+			if len(w.pending)%w.opts.BatchSize == 0 {
+				w.flush()
+			}
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+func (w *Writer) flush() {
+	if len(w.pending) == 0 {
+		return
+	}
+	var err error
+	if w.conn != nil {
+		err = w.write_udp()
+	} else {
+		err = w.write_http()
+	}
+	if err == nil {
+		counters.InfluxWritten.Add(float64(len(w.pending)))
+		w.pending = w.pending[:0]
+		return
+	}
+	counters.Errors.Inc()
+	slog.Error(tagBase.F("Write failed"), "host", w.url.Host, "points", len(w.pending), "err", err)
+	// udp datagrams are not retried, since it is unknown which of them were received
+	limit := w.opts.BatchSize * MAX_BATCHES
+	if w.conn != nil {
+		limit = 0
+	}
+	if over := len(w.pending) - limit; over > 0 {
+		counters.InfluxDropped.Add(float64(over))
+		w.pending = append(w.pending[:0], w.pending[over:]...)
+	}
+}
+
+// lines are packed into datagrams, single line is never split
+func (w *Writer) write_udp() error {
+	var datagram []byte
+	for _, line := range w.pending {
+		if len(datagram) > 0 && len(datagram)+len(line) > MAX_DATAGRAM {
+			if _, err := w.conn.Write(datagram); err != nil {
+				return err
+			}
+			datagram = datagram[:0]
+		}
+		datagram = append(datagram, line...)
+	}
+	_, err := w.conn.Write(datagram)
+	return err
+}
+
+func (w *Writer) write_http() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url.String(), bytes.NewReader(bytes.Join(w.pending, nil)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.opts.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.opts.Token)
+	}
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(rsp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// default writer configured with PINGER_INFLUX_* env variables
+
+var writer *Writer
+
+func Enabled() bool {
+	return writer != nil
+}
+
+// start default writer, no-op when PINGER_INFLUX_URL is empty
+func Start() {
+	conf := registry.Config
+	if conf.InfluxUrl == "" {
+		slog.Info(tagBase.F("Influx writer is disabled"))
+		return
+	}
+	if conf.InfluxBatchSize <= 0 || conf.InfluxFlushInterval <= 0 {
+		panic("PINGER_INFLUX_BATCH_SIZE and PINGER_INFLUX_FLUSH_INTERVAL should be positive")
+	}
+	var err error
+	writer, err = NewWriter(conf.InfluxUrl, Options{
+		Token:         conf.InfluxToken,
+		BatchSize:     conf.InfluxBatchSize,
+		FlushInterval: conf.InfluxFlushInterval,
+		Timeout:       conf.InfluxTimeout,
+	}, nil)
+	if err != nil {
+		panic("invalid PINGER_INFLUX_URL: " + err.Error())
+	}
+	slog.Info(tagBase.F("Started"), "scheme", writer.url.Scheme, "host", writer.url.Host)
+}
+
+func Stop() {
+	if writer != nil {
+		writer.Close()
+	}
+}
+
+var SendStatus workers.OnlineStatusChangeHandler = func(event workers.StatusEvent) {
+	if writer != nil {
+		writer.Send(StatusLine(event))
+	}
+}
+
+var SendPing workers.PingHandler = func(sample workers.PingSample) {
+	if writer != nil {
+		writer.Send(PingLine(sample))
+	}
+}
@@ -0,0 +1,344 @@
+package jsonlog
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/logger"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+	"github.com/fedulovivan/mhz19-go/pkg/utils"
+)
+
+// optional machine readable log, every status event, received command and command result
+// is appended to PINGER_JSONL_FILE as one json object per line. file is rotated when it grows over
+// PINGER_JSONL_MAX_SIZE_MB or gets older than PINGER_JSONL_MAX_AGE (checked on write and once a minute),
+// rotated files are renamed to <name>-<timestamp><ext>, gzipped when PINGER_JSONL_COMPRESS is set and only
+// PINGER_JSONL_BACKUPS most recent ones are kept. compression and pruning run in separate
+// archiver goroutine, so gzip of a large file does not stall the writer.
+
+const (
+	QUEUE_SIZE       = 1024
+	ARCHIVE_QUEUE    = 16
+	AGE_CHECK_PERIOD = time.Minute
+	ROTATED_TS       = "20060102T150405.000"
+	KIND_STATUS      = "status"
+	KIND_COMMAND     = "command"
+	KIND_RESULT      = "result"
+	MEGABYTE         = 1024 * 1024
+	GZIP_EXT         = ".gz"
+	FILE_PERMISSIONS = 0644
+)
+
+var tagBase = utils.NewTag(logger.TAG_JSNL)
+
+type Record struct {
+	Ts        time.Time          `json:"ts"`
+	Kind      string             `json:"kind"`
+	Interface string             `json:"interface,omitempty"`
+	Action    string             `json:"action,omitempty"`
+	Target    workers.TargetAddr `json:"target,omitempty"`
+	Seq       int                `json:"seq,omitempty"`
+	// http status code of the result
+	Code    int                  `json:"code,omitempty"`
+	Message string               `json:"message,omitempty"`
+	IsError bool                 `json:"error,omitempty"`
+	Event   *workers.StatusEvent `json:"event,omitempty"`
+}
+
+var (
+	// guards queue against writes after close, since commands could arrive during shutdown
+	lock   sync.RWMutex
+	closed bool
+	queue  chan Record
+	wg     sync.WaitGroup
+	// rotated files to be compressed and pruned
+	archive   chan string
+	archiveWg sync.WaitGroup
+	file      *os.File
+	size      int64
+	openedAt  time.Time
+)
+
+func Enabled() bool {
+	return queue != nil
+}
+
+// open file and start writer goroutine, no-op when PINGER_JSONL_FILE is empty
+func Open() {
+	fileName := registry.Config.JsonlFile
+	if fileName == "" {
+		slog.Info(tagBase.F("Json lines log is disabled"))
+		return
+	}
+	if err := open(); err != nil {
+		panic("failed to open json lines log: " + err.Error())
+	}
+	queue = make(chan Record, QUEUE_SIZE)
+	archive = make(chan string, ARCHIVE_QUEUE)
+	wg.Add(1)
+	go writer()
+	archiveWg.Add(1)
+	go archiver()
+	slog.Info(tagBase.F("Opened"), "file", fileName)
+}
+
+// write queued records and close file
+func Close() {
+	if queue == nil {
+		return
+	}
+	lock.Lock()
+	closed = true
+	close(queue)
+	lock.Unlock()
+	wg.Wait()
+	// rotated files are archived before exit
+	close(archive)
+	archiveWg.Wait()
+	if err := file.Close(); err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to close"), "err", err)
+	}
+}
+
+// never blocks, record is dropped when queue is full
+func write(r Record) {
+	if queue == nil {
+		return
+	}
+	if r.Ts.IsZero() {
+		r.Ts = time.Now()
+	}
+	lock.RLock()
+	defer lock.RUnlock()
+	if closed {
+		return
+	}
+	select {
+	case queue <- r:
+	default:
+		counters.JsonlDropped.Inc()
+	}
+}
+
+// status change sink
+var SendStatus workers.OnlineStatusChangeHandler = func(event workers.StatusEvent) {
+	write(Record{Ts: event.Ts, Kind: KIND_STATUS, Target: event.Target, Event: &event})
+}
+
+// command received with mqtt or http api
+func Command(iface string, action string, target workers.TargetAddr, seq int) {
+	write(Record{Kind: KIND_COMMAND, Interface: iface, Action: action, Target: target, Seq: seq})
+}
+
+// result of mqtt command
+func Result(iface string, action string, target workers.TargetAddr, seq int, message string, isError bool) {
+	write(Record{Kind: KIND_RESULT, Interface: iface, Action: action, Target: target, Seq: seq, Message: message, IsError: isError})
+}
+
+// result of http command
+func HttpResult(action string, target workers.TargetAddr, code int, message string) {
+	write(Record{Kind: KIND_RESULT, Interface: "http", Action: action, Target: target, Code: code, Message: message, IsError: code >= 400})
+}
+
+// age is also checked on timer, so the file does not stay open past PINGER_JSONL_MAX_AGE when nothing is written
+func writer() {
+	defer wg.Done()
+	var tick <-chan time.Time
+	if maxAge := registry.Config.JsonlMaxAge; maxAge > 0 {
+		ticker := time.NewTicker(min(maxAge, AGE_CHECK_PERIOD))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case r, ok := <-queue:
+			if !ok {
+				return
+			}
+			writeRecord(r)
+		case <-tick:
+			rotateIfNeeded(0)
+		}
+	}
+}
+
+func writeRecord(r Record) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to encode record"), "err", err)
+		return
+	}
+	line = append(line, '\n')
+	rotateIfNeeded(int64(len(line)))
+	n, err := file.Write(line)
+	size += int64(n)
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to write"), "err", err)
+	}
+}
+
+func rotateIfNeeded(next int64) {
+	if !shouldRotate(next) {
+		return
+	}
+	if err := rotate(); err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to rotate"), "err", err)
+	}
+}
+
+// existing file is appended, its age is counted from the application start
+func open() error {
+	f, err := os.OpenFile(registry.Config.JsonlFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, FILE_PERMISSIONS)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	file, size, openedAt = f, info.Size(), time.Now()
+	return nil
+}
+
+func shouldRotate(next int64) bool {
+	if size == 0 {
+		return false
+	}
+	conf := registry.Config
+	if conf.JsonlMaxSizeMb > 0 && size+next > int64(conf.JsonlMaxSizeMb)*MEGABYTE {
+		return true
+	}
+	return conf.JsonlMaxAge > 0 && time.Since(openedAt) > conf.JsonlMaxAge
+}
+
+// base name and extension of the rotated files, e.g. "events" and ".jsonl" for events.jsonl
+func nameParts() (string, string) {
+	fileName := registry.Config.JsonlFile
+	ext := filepath.Ext(fileName)
+	return strings.TrimSuffix(fileName, ext), ext
+}
+
+func rotate() error {
+	if err := file.Close(); err != nil {
+		return err
+	}
+	base, ext := nameParts()
+	rotated := base + "-" + time.Now().Format(ROTATED_TS) + ext
+	renameErr := os.Rename(registry.Config.JsonlFile, rotated)
+	// current file should be reopened anyway, otherwise nothing could be written
+	if err := open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	slog.Info(tagBase.F("Rotated"), "file", rotated)
+	select {
+	case archive <- rotated:
+	default:
+		// rotations are rare, so archiver is not expected to fall that far behind
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Archive queue is full, file is left as is"), "file", rotated)
+	}
+	return nil
+}
+
+// compress and prune rotated files
+func archiver() {
+	defer archiveWg.Done()
+	for rotated := range archive {
+		if registry.Config.JsonlCompress {
+			if err := compress(rotated); err != nil {
+				counters.Errors.Inc()
+				slog.Error(tagBase.F("Failed to compress"), "file", rotated, "err", err)
+			}
+		}
+		if err := prune(); err != nil {
+			counters.Errors.Inc()
+			slog.Error(tagBase.F("Failed to prune"), "err", err)
+		}
+	}
+}
+
+func compress(fileName string) error {
+	src, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(fileName+GZIP_EXT, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, FILE_PERMISSIONS)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(fileName + GZIP_EXT)
+		return err
+	}
+	return os.Remove(fileName)
+}
+
+// whether the file name is <base>-<ROTATED_TS><ext>, optionally gzipped,
+// so unrelated files with similar names (like events-old.jsonl.bak) are never removed
+func isRotated(fileName string, base string, ext string) bool {
+	ts, ok := strings.CutPrefix(fileName, base+"-")
+	if !ok {
+		return false
+	}
+	ts, ok = strings.CutSuffix(strings.TrimSuffix(ts, GZIP_EXT), ext)
+	if !ok || len(ts) != len(ROTATED_TS) {
+		return false
+	}
+	_, err := time.Parse(ROTATED_TS, ts)
+	return err == nil
+}
+
+// remove the oldest rotated files, timestamp in the name keeps them sorted
+func prune() error {
+	keep := registry.Config.JsonlBackups
+	if keep <= 0 {
+		return nil
+	}
+	base, ext := nameParts()
+	candidates, err := filepath.Glob(base + "-*" + ext + "*")
+	if err != nil {
+		return err
+	}
+	matches := candidates[:0]
+	for _, m := range candidates {
+		if isRotated(m, base, ext) {
+			matches = append(matches, m)
+		}
+	}
+	sort.Strings(matches)
+	for len(matches) > keep {
+		if err := os.Remove(matches[0]); err != nil {
+			return err
+		}
+		slog.Info(tagBase.F("Removed old file"), "file", matches[0])
+		matches = matches[1:]
+	}
+	return nil
+}
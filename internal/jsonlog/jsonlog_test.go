@@ -0,0 +1,27 @@
+package jsonlog
+
+import "testing"
+
+func TestIsRotated(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected bool
+	}{
+		{"/data/events-20240101T100000.000.jsonl", true},
+		{"/data/events-20240101T100000.000.jsonl.gz", true},
+		{"/data/events.jsonl", false},
+		{"/data/events-old.jsonl", false},
+		{"/data/events-old.jsonl.bak", false},
+		{"/data/events-20240101T100000.000.jsonl.bak", false},
+		{"/data/events-20240101T100000.000-copy.jsonl", false},
+		{"/data/events-2024010.jsonl", false},
+		{"/data/other-20240101T100000.000.jsonl", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isRotated(c.name, "/data/events", ".jsonl"); got != c.expected {
+				t.Errorf("got %v, expected %v", got, c.expected)
+			}
+		})
+	}
+}
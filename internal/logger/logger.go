@@ -15,6 +15,16 @@ const (
 	TAG_MAIN utils.TagName = "[main   ]"
 	TAG_MQTT utils.TagName = "[mqtt   ]"
 	TAG_WRKR utils.TagName = "[worker ]"
+	TAG_HOMI utils.TagName = "[homie  ]"
+	TAG_HTTP utils.TagName = "[http   ]"
+	TAG_STAT utils.TagName = "[state  ]"
+	TAG_STOR utils.TagName = "[storage]"
+	TAG_SUMM utils.TagName = "[summary]"
+	TAG_HOOK utils.TagName = "[webhook]"
+	TAG_BUS  utils.TagName = "[bus    ]"
+	TAG_JSNL utils.TagName = "[jsonl  ]"
+	TAG_SLOG utils.TagName = "[syslog ]"
+	TAG_INFL utils.TagName = "[influx ]"
 )
 
 func init() {
@@ -0,0 +1,126 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/jsonlog"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+// single entry of add-many/del-many payload,
+// accepts either plain string `"192.168.0.1"` or object `{"target":"192.168.0.1","name":"phone"}`
+type BulkItem struct {
+	Target   workers.TargetAddr `json:"target" jsonschema:"required"`
+	Name     string             `json:"name,omitempty"`
+	Labels   map[string]string  `json:"labels,omitempty"`
+	Schedule string             `json:"schedule,omitempty"`
+	Parent   workers.TargetAddr `json:"parent,omitempty"`
+}
+
+func (i *BulkItem) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == LBRACKET {
+		type plain BulkItem
+		return json.Unmarshal(b, (*plain)(i))
+	}
+	return json.Unmarshal(b, &i.Target)
+}
+
+type BulkItemResult struct {
+	Target  workers.TargetAddr `json:"target"`
+	Message string             `json:"message"`
+	IsError bool               `json:"error"`
+}
+
+type BulkResponse struct {
+	Seq     int              `json:"seq"`
+	Results []BulkItemResult `json:"results"`
+	IsError bool             `json:"error"`
+}
+
+type ListResponse struct {
+	Seq     int                  `json:"seq"`
+	Targets []workers.TargetInfo `json:"targets"`
+}
+
+func addOne(item BulkItem) error {
+	_, err := workersCollection.Create(
+		item.Target,
+		workers.Meta{Name: item.Name, Labels: item.Labels, Schedule: item.Schedule, Parent: item.Parent},
+	)
+	return err
+}
+
+// parents go first, so children in the same request could refer to them
+func sortByParent(items []BulkItem) []BulkItem {
+	// duplicates are kept in their order, Create rejects them anyway
+	index := map[workers.TargetAddr][]BulkItem{}
+	targets := make([]workers.TargetAddr, 0, len(items))
+	for _, item := range items {
+		index[item.Target] = append(index[item.Target], item)
+		targets = append(targets, item.Target)
+	}
+	targets = workers.SortByParent(targets, func(t workers.TargetAddr) workers.TargetAddr {
+		return index[t][0].Parent
+	})
+	res := make([]BulkItem, 0, len(items))
+	for _, t := range targets {
+		res = append(res, index[t][0])
+		index[t] = index[t][1:]
+	}
+	return res
+}
+
+func delOne(item BulkItem) error {
+	return workersCollection.Delete(item.Target)
+}
+
+func bulkApply(items []BulkItem, op func(BulkItem) error, okMessage string) []BulkItemResult {
+	results := make([]BulkItemResult, 0, len(items))
+	for _, item := range items {
+		result := BulkItemResult{Target: item.Target, Message: okMessage}
+		if err := op(item); err != nil {
+			result.Message = err.Error()
+			result.IsError = true
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func SendBulkFeedback(req *Request, results []BulkItemResult) {
+	rsp := BulkResponse{
+		Seq:     req.Seq,
+		Results: results,
+	}
+	req.responded = true
+	for _, r := range results {
+		jsonlog.Result("mqtt", req.action, r.Target, req.Seq, r.Message, r.IsError)
+		if r.IsError {
+			rsp.IsError = true
+			counters.Errors.Inc()
+			slog.Error(tagBase.F("Error"), "target", r.Target, "err", r.Message)
+		}
+	}
+	err := Publish("", "rsp", rsp)
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Error"), "err", err)
+	}
+}
+
+func SendList(req *Request) {
+	rsp := ListResponse{
+		Seq:     req.Seq,
+		Targets: []workers.TargetInfo{},
+	}
+	for _, worker := range workersCollection.List() {
+		rsp.Targets = append(rsp.Targets, worker.Info())
+	}
+	err := Publish("", "targets", rsp)
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Error"), "err", err)
+	}
+}
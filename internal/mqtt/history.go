@@ -0,0 +1,32 @@
+package mqtt
+
+import (
+	"log/slog"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+type HistoryResponse struct {
+	Seq         int                  `json:"seq"`
+	Target      workers.TargetAddr   `json:"target"`
+	Transitions []workers.Transition `json:"transitions"`
+}
+
+// history is requested with <base>/<ip>/history and published to <base>/<ip>/transitions
+func SendHistory(req *Request, worker *workers.Worker) {
+	rsp := HistoryResponse{
+		Seq:    req.Seq,
+		Target: worker.Target(),
+		Transitions: worker.History(workers.HistoryQuery{
+			From:  req.From,
+			To:    req.To,
+			Limit: req.Limit,
+		}),
+	}
+	err := Publish(worker.Target(), "transitions", rsp)
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Error"), "err", err)
+	}
+}
@@ -7,9 +7,12 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fedulovivan/device-pinger/internal/auth"
 	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/jsonlog"
 	"github.com/fedulovivan/device-pinger/internal/logger"
 	"github.com/fedulovivan/device-pinger/internal/registry"
 	"github.com/fedulovivan/device-pinger/internal/workers"
@@ -20,10 +23,28 @@ import (
 
 var LBRACKET = byte('{')
 
+var LSQBRACKET = byte('[')
+
 var tagBase = utils.NewTag(logger.TAG_MQTT)
 
 type Request struct {
-	Seq int `json:"seq"`
+	Seq       int               `json:"seq"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Schedule  string            `json:"schedule"`
+	Parent    string            `json:"parent"`
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+	Limit     int               `json:"limit"`
+	Targets   []BulkItem        `json:"targets"`
+	Secret    string            `json:"secret"`
+	Signature string            `json:"sig"`
+	Ts        int64             `json:"ts"`
+	// set by dispatcher, used to log command results
+	action    string
+	responded bool
+	// raw json object, signature is verified against it
+	payload []byte
 }
 
 type SequencedResponse struct {
@@ -36,6 +57,8 @@ type StatusResponse struct {
 	Status    workers.OnlineStatus `json:"status"`
 	LastSeen  time.Time            `json:"lastSeen"`
 	UpdSource workers.UpdSource    `json:"updSource"`
+	// included into responses to get requests only
+	Report *workers.Report `json:"report,omitempty"`
 }
 
 type StatsResponse struct {
@@ -46,29 +69,73 @@ type StatsResponse struct {
 
 var client MqttLib.Client
 
+// set once all api subscriptions are settled after (re)connect, reset on connection loss
+var subscribed atomic.Bool
+
 var workersCollection *workers.Collection
 
+// extension points for other outputs (like homie), should be set before Connect()
+var (
+	connectHooks []func()
+	will         *willMessage
+)
+
+type willMessage struct {
+	topic    string
+	payload  string
+	qos      byte
+	retained bool
+}
+
+// hook is executed after each successful (re)connect
+func OnConnect(hook func()) {
+	connectHooks = append(connectHooks, hook)
+}
+
+func SetWill(topic string, payload string, qos byte, retained bool) {
+	will = &willMessage{topic, payload, qos, retained}
+}
+
 func GetBokerString() string {
-	return fmt.Sprintf("tcp://%s:%d", registry.Config.MqttHost, registry.Config.MqttPort)
+	path := ""
+	if isWebsocket() {
+		path = registry.Config.MqttPath
+	}
+	return fmt.Sprintf("%s://%s:%d%s", scheme(), registry.Config.MqttHost, registry.Config.MqttPort, path)
 }
 
 func Connect(wc *workers.Collection) func() {
 	workersCollection = wc
+	if err := validateScheme(); err != nil {
+		panic(err.Error())
+	}
 	opts := MqttLib.NewClientOptions()
 	opts.AddBroker(GetBokerString())
 	opts.SetClientID(registry.Config.MqttClientId)
 	opts.SetUsername(registry.Config.MqttUsername)
 	opts.SetPassword(registry.Config.MqttPassword)
+	if isSecure() {
+		tlsConfig, err := newTLSConfig()
+		if err != nil {
+			panic("failed to build mqtt tls config: " + err.Error())
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if will != nil {
+		opts.SetWill(will.topic, will.payload, will.qos, will.retained)
+	}
 	opts.SetDefaultPublishHandler(defaultMessageHandler)
+	// handlers publish responses and wait for their acks, which could not be processed,
+	// while the router is blocked by the handler with ordered delivery
+	opts.SetOrderMatters(false)
 	opts.OnConnect = connectHandler
 	opts.OnConnectionLost = connectLostHandler
 	client = MqttLib.NewClient(opts)
 	slog.Debug(tagBase.F("Connecting..."))
+	// subscriptions are (re)established in connectHandler
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		counters.Errors.Inc()
-		slog.Error(tagBase.F("Error"), "error", token.Error())
-	} else {
-		subscribeAll(client)
+		slog.Error(tagBase.F("Failed to connect"), "broker", GetBokerString(), "error", describeConnectError(token.Error()))
 	}
 	return func() {
 		slog.Debug(tagBase.F("Disconnect..."))
@@ -87,18 +154,28 @@ func BuildTopic(target workers.TargetAddr, action string) string {
 }
 
 func Publish(target workers.TargetAddr, action string, rsp any /* , tagext utils.Tag */) error {
-	payload, err := json.Marshal(rsp)
+	return publishStream(TopicData{Target: target, Action: action}, rsp, rsp)
+}
+
+func publishStream(td TopicData, tplData any, jsonData any) error {
+	payload, err := renderPayload(td.Action, tplData, jsonData)
 	if err != nil {
 		return err
 	}
-	topic := BuildTopic(target, action)
-	token := client.Publish(
-		topic,
-		0,
-		false,
-		payload,
-	)
-	token.Wait()
+	topic, err := renderTopic(td)
+	if err != nil {
+		return err
+	}
+	return PublishRaw(topic, streamQos(td.Action), false, payload)
+}
+
+// publish raw payload to arbitrary topic, bypassing stream templates
+func PublishRaw(topic string, qos byte, retained bool, payload []byte) error {
+	token := client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(registry.Config.MqttTimeout) {
+		counters.MqttTimeouts.WithLabelValues("publish").Inc()
+		return fmt.Errorf("publish to %s timed out after %v", topic, registry.Config.MqttTimeout)
+	}
 	if token.Error() != nil {
 		return token.Error()
 	}
@@ -107,33 +184,49 @@ func Publish(target workers.TargetAddr, action string, rsp any /* , tagext utils
 	return nil
 }
 
-func SendStats() {
+// subscribe with dedicated handler, instead of the default one which dispatches api actions
+func Subscribe(topic string, handler func(topic string, payload []byte)) {
+	subscribeOne(client, topic, func(c MqttLib.Client, msg MqttLib.Message) {
+		counters.MqttReceived.Inc()
+		slog.Debug(
+			tagBase.F("Received"),
+			"topic", msg.Topic(),
+			"payload", utils.Truncate(string(msg.Payload()), 80),
+		)
+		handler(msg.Topic(), msg.Payload())
+	}, nil)
+}
+
+func GetStats() StatsResponse {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
-	rsp := StatsResponse{
+	return StatsResponse{
 		MemoryAlloc: m.Alloc,
 		Workers:     workersCollection.Len(),
 		Uptime:      registry.GetUptime(),
 	}
-	err := Publish("", "stats", rsp)
+}
+
+func SendStats() {
+	err := Publish("", "stats", GetStats())
 	if err != nil {
 		counters.Errors.Inc()
 		slog.Error(tagBase.F("Error"), "err", err)
 	}
 }
 
-var SendStatus workers.OnlineStatusChangeHandler = func(
-	target workers.TargetAddr,
-	status workers.OnlineStatus,
-	lastSeen time.Time,
-	updSource workers.UpdSource,
-) {
+var SendStatus workers.OnlineStatusChangeHandler = func(event workers.StatusEvent) {
 	rsp := StatusResponse{
-		Status:    status,
-		LastSeen:  lastSeen,
-		UpdSource: updSource,
+		Status:    event.Status,
+		LastSeen:  event.LastSeen,
+		UpdSource: event.UpdSource,
+		Report:    event.Report,
 	}
-	err := Publish(target, "status", rsp)
+	err := publishStream(
+		TopicData{Target: event.Target, Action: "status", Meta: event.Meta},
+		event,
+		rsp,
+	)
 	if err != nil {
 		counters.Errors.Inc()
 		slog.Error(tagBase.F("Error"), "err", err)
@@ -141,6 +234,8 @@ var SendStatus workers.OnlineStatusChangeHandler = func(
 }
 
 func SendOpFeedback(req *Request, target workers.TargetAddr, message string, isError bool) {
+	req.responded = true
+	jsonlog.Result("mqtt", req.action, target, req.Seq, message, isError)
 	rsp := SequencedResponse{
 		Message: message,
 		IsError: isError,
@@ -158,6 +253,20 @@ func SendOpFeedback(req *Request, target workers.TargetAddr, message string, isE
 }
 
 func dispatchAction(action string, target workers.TargetAddr, req *Request) {
+	req.action = action
+	jsonlog.Command("mqtt", action, target, req.Seq)
+	err := auth.CheckAction(action, string(target), auth.Credentials{
+		Secret:    req.Secret,
+		Signature: req.Signature,
+		Ts:        req.Ts,
+		Seq:       req.Seq,
+		Payload:   req.payload,
+	})
+	if err != nil {
+		auth.Reject("mqtt", action)
+		SendOpFeedback(req, target, err.Error(), true)
+		return
+	}
 	handled := false
 	switch action {
 	case "get-stats":
@@ -167,17 +276,52 @@ func dispatchAction(action string, target workers.TargetAddr, req *Request) {
 		slog.Debug(tagBase.F("Getting status for %v", target))
 		worker, err := workersCollection.Get(target)
 		if err == nil {
-			SendStatus(target, worker.Status(), worker.LastSeen(), workers.UPD_SOURCE_MQTT_GET)
+			event := worker.Event(workers.UPD_SOURCE_MQTT_GET)
+			report := worker.Report()
+			event.Report = &report
+			SendStatus(event)
+			handled = true
+		} else {
+			SendOpFeedback(req, target, err.Error(), true)
+		}
+	case "report":
+		worker, err := workersCollection.Get(target)
+		if err == nil {
+			SendReport(req, worker)
 			handled = true
 		} else {
 			SendOpFeedback(req, target, err.Error(), true)
 		}
+	case "history":
+		worker, err := workersCollection.Get(target)
+		if err == nil {
+			SendHistory(req, worker)
+			handled = true
+		} else {
+			SendOpFeedback(req, target, err.Error(), true)
+		}
+	case "list":
+		SendList(req)
+		handled = true
+	case "get-all":
+		for _, worker := range workersCollection.List() {
+			SendStatus(worker.Event(workers.UPD_SOURCE_MQTT_GET))
+		}
+		handled = true
+	case "add-many":
+		slog.Debug(tagBase.F("Adding %d new workers", len(req.Targets)))
+		SendBulkFeedback(req, bulkApply(sortByParent(req.Targets), addOne, "added"))
+		SendStats()
+		handled = true
+	case "del-many":
+		slog.Debug(tagBase.F("Deleting %d workers", len(req.Targets)))
+		SendBulkFeedback(req, bulkApply(req.Targets, delOne, "deleted"))
+		runtime.GC()
+		SendStats()
+		handled = true
 	case "add":
 		slog.Debug(tagBase.F("Adding new worker for %v", target))
-		_, err := workersCollection.Create(
-			target,
-			SendStatus,
-		)
+		err := addOne(BulkItem{Target: target, Name: req.Name, Labels: req.Labels, Schedule: req.Schedule, Parent: workers.TargetAddr(req.Parent)})
 		if err == nil {
 			SendOpFeedback(req, target, "added", false)
 			SendStats()
@@ -187,7 +331,7 @@ func dispatchAction(action string, target workers.TargetAddr, req *Request) {
 		}
 	case "del":
 		slog.Debug(tagBase.F("Deleting worker for %v", target))
-		err := workersCollection.Delete(target, SendStatus)
+		err := delOne(BulkItem{Target: target})
 		runtime.GC()
 		if err == nil {
 			SendOpFeedback(req, target, "deleted", false)
@@ -196,10 +340,32 @@ func dispatchAction(action string, target workers.TargetAddr, req *Request) {
 		} else {
 			SendOpFeedback(req, target, err.Error(), true)
 		}
+	case "pause":
+		slog.Debug(tagBase.F("Pausing worker for %v", target))
+		_, err := workersCollection.Pause(target)
+		if err == nil {
+			SendOpFeedback(req, target, "paused", false)
+			handled = true
+		} else {
+			SendOpFeedback(req, target, err.Error(), true)
+		}
+	case "resume":
+		slog.Debug(tagBase.F("Resuming worker for %v", target))
+		_, err := workersCollection.Resume(target)
+		if err == nil {
+			SendOpFeedback(req, target, "resumed", false)
+			handled = true
+		} else {
+			SendOpFeedback(req, target, err.Error(), true)
+		}
 	}
 	if handled {
 		counters.ActionsHandled.WithLabelValues(action, string(target)).Inc()
 	}
+	// queries are answered on their own topics
+	if handled && !req.responded {
+		jsonlog.Result("mqtt", action, target, req.Seq, "ok", false)
+	}
 }
 
 var defaultMessageHandler MqttLib.MessageHandler = func(client MqttLib.Client, msg MqttLib.Message) {
@@ -218,69 +384,133 @@ var defaultMessageHandler MqttLib.MessageHandler = func(client MqttLib.Client, m
 
 	ttlen := len(tt)
 
+	var action string
+	var target workers.TargetAddr
+	if ttlen == 2 {
+		action = tt[1]
+	} else if ttlen == 3 {
+		target = workers.TargetAddr(tt[1])
+		action = tt[2]
+	} else {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Unexpected topic format %v", topic))
+		return
+	}
+
 	message := Request{}
 
-	tryAsJson := len(msg.Payload()) > 0 && msg.Payload()[0] == LBRACKET
+	payload := msg.Payload()
+
+	tryAsJson := len(payload) > 0 && payload[0] == LBRACKET
+
+	tryAsJsonArray := len(payload) > 0 && payload[0] == LSQBRACKET
+
+	if tryAsJson || tryAsJsonArray {
+		err := validatePayload(payload, tryAsJsonArray)
+		if err != nil {
+			// best effort to get seq for the feedback, errors are ignored since payload is already known to be invalid
+			_ = json.Unmarshal(payload, &message)
+			message.action = action
+			jsonlog.Command("mqtt", action, target, message.Seq)
+			counters.PayloadsRejected.WithLabelValues(action).Inc()
+			SendOpFeedback(&message, target, "invalid payload: "+err.Error(), true)
+			return
+		}
+	}
 
 	if tryAsJson {
-		err := json.Unmarshal(msg.Payload(), &message)
+		message.payload = payload
+		err := json.Unmarshal(payload, &message)
 		if err != nil {
 			counters.Errors.Inc()
 			slog.Error(tagBase.F("Failed to parse message payload into json"), "err", err)
 		}
+	} else if tryAsJsonArray {
+		message.payload = payload
+		err := json.Unmarshal(payload, &message.Targets)
+		if err != nil {
+			counters.Errors.Inc()
+			slog.Error(tagBase.F("Failed to parse message payload into json array"), "err", err)
+		}
 	}
 
-	if ttlen == 2 {
-		action := tt[1]
-		dispatchAction(action, "", &message)
-	} else if ttlen == 3 {
-		target := workers.TargetAddr(tt[1])
-		action := tt[2]
-		dispatchAction(action, target, &message)
-	} else {
-		counters.Errors.Inc()
-		slog.Error(tagBase.F("Unexpected topic format %v", topic))
-		return
-	}
+	dispatchAction(action, target, &message)
 
 }
 
 var connectHandler MqttLib.OnConnectHandler = func(client MqttLib.Client) {
 	slog.Info(tagBase.F("Connected"), "broker", GetBokerString())
+	// session is not persisted, so subscriptions should be restored after each reconnect
+	subscribeAll(client)
+	for _, hook := range connectHooks {
+		hook()
+	}
 }
 
 var connectLostHandler MqttLib.ConnectionLostHandler = func(client MqttLib.Client, err error) {
+	subscribed.Store(false)
 	counters.Errors.Inc()
 	slog.Error(tagBase.F("Connection lost"), "err", err)
 }
 
-func subscribeOne(client MqttLib.Client, topic string, wg *sync.WaitGroup) {
+func IsConnected() bool {
+	return client != nil && client.IsConnectionOpen()
+}
+
+func IsSubscribed() bool {
+	return subscribed.Load()
+}
+
+func subscribeOne(client MqttLib.Client, topic string, callback MqttLib.MessageHandler, wg *sync.WaitGroup) (ok bool) {
 	if wg != nil {
 		defer wg.Done()
 	}
-	if token := client.Subscribe(topic, 0, nil); token.Wait() && token.Error() != nil {
+	token := client.Subscribe(topic, registry.Config.MqttQosReq, callback)
+	if !token.WaitTimeout(registry.Config.MqttTimeout) {
+		counters.MqttTimeouts.WithLabelValues("subscribe").Inc()
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("client.Subscribe() timed out"), "topic", topic, "timeout", registry.Config.MqttTimeout)
+		return false
+	}
+	if token.Error() != nil {
 		counters.Errors.Inc()
 		slog.Error(tagBase.F("client.Subscribe()"), "err", token.Error())
+		return false
 	}
 	slog.Info(tagBase.F("Subscribed to"), "topic", topic)
+	return true
 }
 
 func subscribeAll(client MqttLib.Client) {
 	suffixes := []string{
 		"get-stats",
+		"list",
+		"get-all",
+		"add-many",
+		"del-many",
 		"+/add",
 		"+/get",
 		"+/del",
+		"+/pause",
+		"+/resume",
+		"+/history",
+		"+/report",
 	}
 	var wg sync.WaitGroup
+	var failed atomic.Int32
 	wg.Add(len(suffixes))
 	for _, suffix := range suffixes {
-		go subscribeOne(
-			client,
-			registry.Config.MqttTopicBase+"/"+suffix,
-			&wg,
-		)
+		go func(topic string) {
+			if !subscribeOne(client, topic, nil, &wg) {
+				failed.Add(1)
+			}
+		}(registry.Config.MqttTopicBase + "/" + suffix)
 	}
 	wg.Wait()
+	if failed.Load() > 0 {
+		slog.Error(tagBase.F("Some subscribtions were not settled"), "failed", failed.Load())
+		return
+	}
+	subscribed.Store(true)
 	slog.Debug(tagBase.F("All subscribtions are settled"))
 }
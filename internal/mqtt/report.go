@@ -0,0 +1,26 @@
+package mqtt
+
+import (
+	"log/slog"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+type ReportResponse struct {
+	Seq int `json:"seq"`
+	workers.Report
+}
+
+// report is requested with <base>/<ip>/report and published to <base>/<ip>/availability
+func SendReport(req *Request, worker *workers.Worker) {
+	rsp := ReportResponse{
+		Seq:    req.Seq,
+		Report: worker.Report(),
+	}
+	err := Publish(worker.Target(), "availability", rsp)
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Error"), "err", err)
+	}
+}
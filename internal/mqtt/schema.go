@@ -0,0 +1,41 @@
+package mqtt
+
+import (
+	"github.com/fedulovivan/device-pinger/internal/schema"
+)
+
+// incoming json payloads are validated against schemas generated from the request types,
+// so malformed commands are rejected with precise error instead of being silently ignored.
+// unknown keys are still allowed, since existing clients could send them
+
+func init() {
+	schema.Define(BulkItem{}, &schema.Schema{
+		OneOf: []*schema.Schema{
+			{Type: "string", Description: "target ip"},
+			schema.Open(schema.Fields(BulkItem{})),
+		},
+	})
+	schema.Define(Request{}, schema.Open(schema.Fields(Request{})))
+}
+
+// schemas of the payloads, served by http api
+func Schemas() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"Request":           schema.For(Request{}),
+		"BulkItem":          schema.For(BulkItem{}),
+		"SequencedResponse": schema.For(SequencedResponse{}),
+		"StatusResponse":    schema.For(StatusResponse{}),
+		"StatsResponse":     schema.For(StatsResponse{}),
+		"BulkResponse":      schema.For(BulkResponse{}),
+		"ListResponse":      schema.For(ListResponse{}),
+		"HistoryResponse":   schema.For(HistoryResponse{}),
+		"ReportResponse":    schema.For(ReportResponse{}),
+	}
+}
+
+func validatePayload(payload []byte, isArray bool) error {
+	if isArray {
+		return schema.Validate(schema.For([]BulkItem{}), payload)
+	}
+	return schema.Validate(schema.For(Request{}), payload)
+}
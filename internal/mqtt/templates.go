@@ -0,0 +1,115 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+// data for the topic templates, e.g. "presence/{{.Name}}" or "{{.Base}}/{{index .Labels "room"}}/{{.Target}}"
+type TopicData struct {
+	Base   string
+	Target workers.TargetAddr
+	Action string
+	workers.Meta
+}
+
+// output stream is a topic and payload templates for one kind of published messages,
+// nil templates mean backward compatible defaults - BuildTopic() and json encoded response
+type stream struct {
+	topic   *template.Template
+	payload *template.Template
+	qos     byte
+}
+
+var streams = map[string]*stream{}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+func parseTemplate(name string, text string) *template.Template {
+	if text == "" {
+		return nil
+	}
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse %s template: %s", name, err.Error()))
+	}
+	return t
+}
+
+func init() {
+	conf := registry.Config
+	streams["status"] = &stream{
+		topic:   parseTemplate("status topic", conf.MqttStatusTopic),
+		payload: parseTemplate("status payload", conf.MqttStatusPayload),
+		qos:     conf.MqttQosStatus,
+	}
+	streams["stats"] = &stream{
+		topic:   parseTemplate("stats topic", conf.MqttStatsTopic),
+		payload: parseTemplate("stats payload", conf.MqttStatsPayload),
+		qos:     conf.MqttQosStats,
+	}
+	streams["rsp"] = &stream{
+		topic:   parseTemplate("rsp topic", conf.MqttRspTopic),
+		payload: parseTemplate("rsp payload", conf.MqttRspPayload),
+		qos:     conf.MqttQosRsp,
+	}
+	streams["targets"] = &stream{
+		topic:   parseTemplate("targets topic", conf.MqttTargetsTopic),
+		payload: parseTemplate("targets payload", conf.MqttTargetsPayload),
+		qos:     conf.MqttQosRsp,
+	}
+	for name, s := range streams {
+		if s.qos > 2 {
+			panic(fmt.Sprintf("unexpected qos %d for %s stream, expected 0, 1 or 2", s.qos, name))
+		}
+	}
+}
+
+func execTemplate(t *template.Template, data any) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func streamQos(action string) byte {
+	if s, ok := streams[action]; ok {
+		return s.qos
+	}
+	return 0
+}
+
+// render topic for the given action, falls back to BuildTopic() if no template is configured
+func renderTopic(td TopicData) (string, error) {
+	s, ok := streams[td.Action]
+	if !ok || s.topic == nil {
+		return BuildTopic(td.Target, td.Action), nil
+	}
+	td.Base = registry.Config.MqttTopicBase
+	return execTemplate(s.topic, td)
+}
+
+// render payload for the given action, tplData is used with template and jsonData without,
+// which allows status stream to expose full event to templates while keeping default json unchanged
+func renderPayload(action string, tplData any, jsonData any) ([]byte, error) {
+	s, ok := streams[action]
+	if !ok || s.payload == nil {
+		return json.Marshal(jsonData)
+	}
+	payload, err := execTemplate(s.payload, tplData)
+	return []byte(payload), err
+}
@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/fedulovivan/device-pinger/internal/registry"
+)
+
+// schemes understood by paho, "mqtts" is normalized to "ssl" for readability in logs
+var SCHEME_ALIASES = map[string]string{
+	"mqtt":  "tcp",
+	"mqtts": "ssl",
+	"tls":   "ssl",
+}
+
+var SCHEMES = []string{"tcp", "ssl", "ws", "wss"}
+
+func scheme() string {
+	s := strings.ToLower(registry.Config.MqttScheme)
+	if alias, ok := SCHEME_ALIASES[s]; ok {
+		return alias
+	}
+	return s
+}
+
+// paho fails on unknown scheme only on connect attempt with a vague error, so it is checked upfront
+func validateScheme() error {
+	for _, s := range SCHEMES {
+		if scheme() == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported MQTT_SCHEME %q, expected one of tcp, ssl, ws, wss or aliases mqtt, mqtts, tls", registry.Config.MqttScheme)
+}
+
+func isSecure() bool {
+	s := scheme()
+	return s == "ssl" || s == "wss"
+}
+
+func isWebsocket() bool {
+	s := scheme()
+	return s == "ws" || s == "wss"
+}
+
+// build tls config from MQTT_CA_FILE, MQTT_CERT_FILE and MQTT_KEY_FILE,
+// empty CA means system pool is used, empty cert/key means no client authentication
+func newTLSConfig() (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         registry.Config.MqttHost,
+		InsecureSkipVerify: registry.Config.MqttInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if registry.Config.MqttCaFile != "" {
+		pem, err := os.ReadFile(registry.Config.MqttCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle %s: %w", registry.Config.MqttCaFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", registry.Config.MqttCaFile)
+		}
+		conf.RootCAs = pool
+	}
+	withCert, withKey := registry.Config.MqttCertFile != "", registry.Config.MqttKeyFile != ""
+	if withCert != withKey {
+		return nil, errors.New("both MQTT_CERT_FILE and MQTT_KEY_FILE should be set for client certificate authentication")
+	}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(registry.Config.MqttCertFile, registry.Config.MqttKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s: %w", registry.Config.MqttCertFile, err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// make connect errors more descriptive, since paho reports raw tls/x509 errors
+func describeConnectError(err error) error {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		recordHeader     tls.RecordHeaderError
+		alert            tls.AlertError
+		opError          *net.OpError
+	)
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return fmt.Errorf("tls handshake failed, broker certificate is signed by unknown authority, check MQTT_CA_FILE: %w", err)
+	case errors.As(err, &hostname):
+		return fmt.Errorf("tls handshake failed, broker certificate does not match MQTT_HOST: %w", err)
+	case errors.As(err, &invalid):
+		return fmt.Errorf("tls handshake failed, broker certificate is invalid or expired: %w", err)
+	case errors.As(err, &recordHeader):
+		return fmt.Errorf("tls handshake failed, broker does not speak tls on this port, check MQTT_SCHEME and MQTT_PORT: %w", err)
+	case errors.As(err, &alert):
+		return fmt.Errorf("tls handshake failed, broker rejected the connection, check MQTT_CERT_FILE and MQTT_KEY_FILE: %w", err)
+	case errors.As(err, &opError):
+		return fmt.Errorf("failed to reach broker %s: %w", GetBokerString(), err)
+	}
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
 	"reflect"
 	"strings"
@@ -17,10 +18,18 @@ import (
 	"github.com/sethvargo/go-envconfig"
 )
 
+// what happens outside of the target monitoring window
+const (
+	SCHEDULE_MODE_SUSPEND  = "suspend"  // stop probing and publish off-schedule status once
+	SCHEDULE_MODE_SUPPRESS = "suppress" // keep probing, but do not publish status transitions
+)
+
 var (
 	Config      ConfigStorage
 	startTime   time.Time
 	startTimeMu sync.Mutex
+	// parsed PINGER_TARGET_LABELS
+	targetLabels = map[string]map[string]string{}
 )
 
 type Uptime struct {
@@ -32,21 +41,125 @@ func (d Uptime) MarshalJSON() (b []byte, err error) {
 }
 
 type ConfigStorage struct {
-	MqttHost               string        `env:"MQTT_HOST,default=mosquitto"`
-	MqttPort               int           `env:"MQTT_PORT,default=1883"`
-	MqttUsername           string        `env:"MQTT_USERNAME"`
-	MqttPassword           string        `env:"MQTT_PASSWORD"`
-	MqttTopicBase          string        `env:"PINGER_MQTT_TOPIC_BASE,default=device-pinger"`
-	MqttClientId           string        `env:"PINGER_MQTT_CLIENT_ID,default=device-pinger"`
-	TargetIps              []string      `env:"PINGER_TARGET_IPS"`
-	OfflineAfter           time.Duration `env:"PINGER_OFFLINE_AFTER,default=30s"`
-	PingerInterval         time.Duration `env:"PINGER_PINGER_INTERVAL,default=5s"`
-	OfflineCheckInterval   time.Duration `env:"PINGER_OFFLINE_CHECK_INTERVAL,default=5s"`
-	PeriodicUpdateInterval time.Duration `env:"PINGER_PERIODIC_UPDATE_INTERVAL,default=10m"`
-	LogLevel               slog.Level    `env:"PINGER_LOG_LEVEL,default=debug"`
-	IsDev                  bool          `env:"PINGER_DEV,default=false"`
-	Tz                     string        `env:"TZ"`
-	PrometheusPort         int           `env:"PINGER_PROMETHEUS_PORT,default=2112"`
+	MqttScheme             string            `env:"MQTT_SCHEME,default=tcp"`
+	MqttHost               string            `env:"MQTT_HOST,default=mosquitto"`
+	MqttPort               int               `env:"MQTT_PORT,default=1883"`
+	MqttPath               string            `env:"MQTT_PATH"`
+	MqttUsername           string            `env:"MQTT_USERNAME"`
+	MqttPassword           string            `env:"MQTT_PASSWORD" redact:"true"`
+	MqttCaFile             string            `env:"MQTT_CA_FILE"`
+	MqttInsecureSkipVerify bool              `env:"MQTT_INSECURE_SKIP_VERIFY,default=false"`
+	MqttCertFile           string            `env:"MQTT_CERT_FILE"`
+	MqttKeyFile            string            `env:"MQTT_KEY_FILE"`
+	MqttTopicBase          string            `env:"PINGER_MQTT_TOPIC_BASE,default=device-pinger"`
+	MqttClientId           string            `env:"PINGER_MQTT_CLIENT_ID,default=device-pinger"`
+	MqttStatusTopic        string            `env:"PINGER_MQTT_STATUS_TOPIC"`
+	MqttStatusPayload      string            `env:"PINGER_MQTT_STATUS_PAYLOAD"`
+	MqttStatsTopic         string            `env:"PINGER_MQTT_STATS_TOPIC"`
+	MqttStatsPayload       string            `env:"PINGER_MQTT_STATS_PAYLOAD"`
+	MqttRspTopic           string            `env:"PINGER_MQTT_RSP_TOPIC"`
+	MqttRspPayload         string            `env:"PINGER_MQTT_RSP_PAYLOAD"`
+	MqttTargetsTopic       string            `env:"PINGER_MQTT_TARGETS_TOPIC"`
+	MqttTargetsPayload     string            `env:"PINGER_MQTT_TARGETS_PAYLOAD"`
+	MqttQosStatus          byte              `env:"PINGER_MQTT_QOS_STATUS,default=0"`
+	MqttQosStats           byte              `env:"PINGER_MQTT_QOS_STATS,default=0"`
+	MqttQosRsp             byte              `env:"PINGER_MQTT_QOS_RSP,default=0"`
+	MqttQosReq             byte              `env:"PINGER_MQTT_QOS_REQ,default=0"`
+	MqttTimeout            time.Duration     `env:"PINGER_MQTT_TIMEOUT,default=5s"`
+	MqttSecret             string            `env:"PINGER_MQTT_SECRET" redact:"true"`
+	MqttPublicActions      []string          `env:"PINGER_MQTT_PUBLIC_ACTIONS,default=get,get-stats,list,get-all,history,report"`
+	MqttSignatureMaxAge    time.Duration     `env:"PINGER_MQTT_SIGNATURE_MAX_AGE,default=5m"`
+	ApiTokens              []string          `env:"PINGER_API_TOKENS" redact:"true"`
+	HomieEnabled           bool              `env:"PINGER_HOMIE_ENABLED,default=false"`
+	HomieBase              string            `env:"PINGER_HOMIE_BASE,default=homie"`
+	HomieDeviceId          string            `env:"PINGER_HOMIE_DEVICE_ID,default=device-pinger"`
+	TargetIps              []string          `env:"PINGER_TARGET_IPS"`
+	TargetNames            map[string]string `env:"PINGER_TARGET_NAMES"`
+	TargetParents          map[string]string `env:"PINGER_TARGET_PARENTS"`
+	TargetSchedules        map[string]string `env:"PINGER_TARGET_SCHEDULES,delimiter=;"`
+	TargetLabels           map[string]string `env:"PINGER_TARGET_LABELS,delimiter=;"`
+	ScheduleMode           string            `env:"PINGER_SCHEDULE_MODE,default=suspend"`
+	OfflineAfter           time.Duration     `env:"PINGER_OFFLINE_AFTER,default=30s"`
+	PingerInterval         time.Duration     `env:"PINGER_PINGER_INTERVAL,default=5s"`
+	OfflineCheckInterval   time.Duration     `env:"PINGER_OFFLINE_CHECK_INTERVAL,default=5s"`
+	PeriodicUpdateInterval time.Duration     `env:"PINGER_PERIODIC_UPDATE_INTERVAL,default=10m"`
+	LivenessMissedTicks    int               `env:"PINGER_LIVENESS_MISSED_TICKS,default=3"`
+	WatchdogInterval       time.Duration     `env:"PINGER_WATCHDOG_INTERVAL,default=10s"`
+	WatchdogStallAfter     time.Duration     `env:"PINGER_WATCHDOG_STALL_AFTER,default=1m"`
+	StateFile              string            `env:"PINGER_STATE_FILE,default=state.json"`
+	HistorySize            int               `env:"PINGER_HISTORY_SIZE,default=100"`
+	DbFile                 string            `env:"PINGER_DB_FILE"`
+	DbRetention            time.Duration     `env:"PINGER_DB_RETENTION,default=720h"`
+	DbRollupRetention      time.Duration     `env:"PINGER_DB_ROLLUP_RETENTION,default=0"`
+	DbSamples              bool              `env:"PINGER_DB_SAMPLES,default=false"`
+	DbSamplesRetention     time.Duration     `env:"PINGER_DB_SAMPLES_RETENTION,default=168h"`
+	SummaryTime            string            `env:"PINGER_SUMMARY_TIME"`
+	SummaryGroupLabel      string            `env:"PINGER_SUMMARY_GROUP_LABEL,default=group"`
+	Webhooks               string            `env:"PINGER_WEBHOOKS" redact:"true"`
+	WebhookSecret          string            `env:"PINGER_WEBHOOK_SECRET" redact:"true"`
+	WebhookTimeout         time.Duration     `env:"PINGER_WEBHOOK_TIMEOUT,default=5s"`
+	WebhookRetries         int               `env:"PINGER_WEBHOOK_RETRIES,default=5"`
+	WebhookBackoff         time.Duration     `env:"PINGER_WEBHOOK_BACKOFF,default=1s"`
+	BusBuffer              int               `env:"PINGER_BUS_BUFFER,default=1024"`
+	JsonlFile              string            `env:"PINGER_JSONL_FILE"`
+	JsonlMaxSizeMb         int               `env:"PINGER_JSONL_MAX_SIZE_MB,default=100"`
+	JsonlMaxAge            time.Duration     `env:"PINGER_JSONL_MAX_AGE,default=24h"`
+	JsonlBackups           int               `env:"PINGER_JSONL_BACKUPS,default=7"`
+	JsonlCompress          bool              `env:"PINGER_JSONL_COMPRESS,default=true"`
+	SyslogAddr             string            `env:"PINGER_SYSLOG_ADDR"`
+	SyslogFacility         string            `env:"PINGER_SYSLOG_FACILITY,default=daemon"`
+	SyslogAppName          string            `env:"PINGER_SYSLOG_APP_NAME,default=device-pinger"`
+	SyslogHostname         string            `env:"PINGER_SYSLOG_HOSTNAME"`
+	InfluxUrl              string            `env:"PINGER_INFLUX_URL" redact:"url"`
+	InfluxToken            string            `env:"PINGER_INFLUX_TOKEN" redact:"true"`
+	InfluxBatchSize        int               `env:"PINGER_INFLUX_BATCH_SIZE,default=500"`
+	InfluxFlushInterval    time.Duration     `env:"PINGER_INFLUX_FLUSH_INTERVAL,default=10s"`
+	InfluxTimeout          time.Duration     `env:"PINGER_INFLUX_TIMEOUT,default=5s"`
+	LogLevel               slog.Level        `env:"PINGER_LOG_LEVEL,default=debug"`
+	IsDev                  bool              `env:"PINGER_DEV,default=false"`
+	Tz                     string            `env:"TZ"`
+	PrometheusPort         int               `env:"PINGER_PROMETHEUS_PORT,default=2112"`
+}
+
+// replacement of the secret values in logs
+const REDACTED = "xxxxx"
+
+// copy of config with values of fields tagged with `redact` hidden, safe for logging.
+// "url" mode hides only credentials: password of user info and well-known query params (like influxdb v1 p)
+func (c ConfigStorage) Redacted() ConfigStorage {
+	v := reflect.ValueOf(&c).Elem()
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		mode := typ.Field(i).Tag.Get("redact")
+		field := v.Field(i)
+		if mode == "" || field.Len() == 0 {
+			continue
+		}
+		switch {
+		case field.Kind() == reflect.String && mode == "url":
+			field.SetString(redactUrl(field.String()))
+		case field.Kind() == reflect.String:
+			field.SetString(REDACTED)
+		case field.Kind() == reflect.Slice:
+			field.Set(reflect.ValueOf([]string{REDACTED}))
+		}
+	}
+	return c
+}
+
+func redactUrl(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return REDACTED
+	}
+	q := u.Query()
+	for _, key := range []string{"p", "password", "token"} {
+		if q.Has(key) {
+			q.Set(key, REDACTED)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.Redacted()
 }
 
 // use reflection to parse Config struct tags and report unexpected variables from .env file
@@ -72,16 +185,27 @@ func init() {
 	}
 	err := godotenv.Load(fileName)
 	if err != nil {
-		fmt.Println("godotenv.Load()", err)
+		fmt.Fprintln(os.Stderr, "godotenv.Load()", err)
 	} else {
-		fmt.Println("env variables were loaded from file", fileName)
+		fmt.Fprintln(os.Stderr, "env variables were loaded from file", fileName)
 	}
 	if err := envconfig.Process(context.Background(), &Config); err != nil {
 		panic("failed loading env variables into struct: " + err.Error())
 	}
-	fmt.Printf("starting with config %+v\n", Config)
+	if err := Config.Validate(); err != nil {
+		panic("invalid config: " + err.Error())
+	}
+	for ip, raw := range Config.TargetLabels {
+		labels, err := ParseLabels(raw)
+		if err != nil {
+			panic(fmt.Sprintf("invalid PINGER_TARGET_LABELS of %s: %s", ip, err))
+		}
+		targetLabels[ip] = labels
+	}
+	// stdout is kept clean for the output of subcommands like export
+	fmt.Fprintf(os.Stderr, "starting with config %+v\n", Config.Redacted())
 	if Config.IsDev {
-		fmt.Println("all known config variables", GetExpectedEnvVars())
+		fmt.Fprintln(os.Stderr, "all known config variables", GetExpectedEnvVars())
 	}
 	// actually tzdata does this automatically, when TZ env is set
 	// if Config.Tz != "" {
@@ -90,6 +214,33 @@ func init() {
 	// }
 }
 
+// checks of the values, which envconfig cannot do itself
+func (c ConfigStorage) Validate() error {
+	if c.ScheduleMode != SCHEDULE_MODE_SUSPEND && c.ScheduleMode != SCHEDULE_MODE_SUPPRESS {
+		return fmt.Errorf("PINGER_SCHEDULE_MODE should be %s or %s, got %q", SCHEDULE_MODE_SUSPEND, SCHEDULE_MODE_SUPPRESS, c.ScheduleMode)
+	}
+	return nil
+}
+
+// parse comma separated list of key=value pairs
+func ParseLabels(raw string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		res[k] = v
+	}
+	return res, nil
+}
+
+// labels of the startup target from PINGER_TARGET_LABELS, nil when not set
+func GetTargetLabels(target string) map[string]string {
+	return targetLabels[target]
+}
+
 func RecordStartTime() {
 	if !startTime.IsZero() {
 		panic("expected to be called only once")
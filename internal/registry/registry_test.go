@@ -0,0 +1,32 @@
+package registry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, mode := range []string{SCHEDULE_MODE_SUSPEND, SCHEDULE_MODE_SUPPRESS} {
+		if err := (ConfigStorage{ScheduleMode: mode}).Validate(); err != nil {
+			t.Errorf("%s: unexpected error %v", mode, err)
+		}
+	}
+	err := ConfigStorage{ScheduleMode: "pause"}.Validate()
+	expected := `PINGER_SCHEDULE_MODE should be suspend or suppress, got "pause"`
+	if err == nil || err.Error() != expected {
+		t.Errorf("got %v, expected %q", err, expected)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels(" group = home ,owner=ivan,empty=")
+	expected := map[string]string{"group": "home", "owner": "ivan", "empty": ""}
+	if err != nil || !reflect.DeepEqual(labels, expected) {
+		t.Errorf("got %v %v, expected %v", labels, err, expected)
+	}
+	for _, raw := range []string{"", "group", "=home", "group=home,"} {
+		if _, err := ParseLabels(raw); err == nil {
+			t.Errorf("%q: expected error", raw)
+		}
+	}
+}
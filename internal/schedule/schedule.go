@@ -0,0 +1,160 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// monitoring windows in form of weekday/time-range list, evaluated in local time zone (TZ env),
+// windows are separated with "|", each window is "<days> <from>-<to>", where both parts are optional:
+//   - "mon-fri 08:00-19:00" - working hours
+//   - "sat,sun" - whole weekend
+//   - "22:00-06:00" - each night, range crossing midnight belongs to the day it starts
+//   - "mon-fri 08:00-19:00 | sat 10:00-14:00" - several windows
+// empty spec means always active
+
+var WEEKDAYS = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+const MINUTES_PER_DAY = 24 * 60
+
+type window struct {
+	days [7]bool
+	from int // minutes since midnight
+	to   int // exclusive, could be less than from for ranges crossing midnight
+}
+
+type Schedule struct {
+	spec    string
+	windows []window
+}
+
+func Parse(spec string) (*Schedule, error) {
+	s := &Schedule{spec: strings.TrimSpace(spec)}
+	if s.spec == "" {
+		return s, nil
+	}
+	for _, part := range strings.Split(s.spec, "|") {
+		w, err := parseWindow(strings.Fields(strings.ToLower(part)))
+		if err != nil {
+			return nil, fmt.Errorf("window %q: %w", strings.TrimSpace(part), err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+func parseWindow(fields []string) (window, error) {
+	w := window{from: 0, to: MINUTES_PER_DAY}
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("expected \"<days> <from>-<to>\"")
+	}
+	// time range always contains colon
+	if strings.Contains(fields[len(fields)-1], ":") {
+		var err error
+		w.from, w.to, err = parseRange(fields[len(fields)-1])
+		if err != nil {
+			return w, err
+		}
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) == 0 || fields[0] == "*" {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+		return w, nil
+	}
+	if len(fields) > 1 {
+		return w, fmt.Errorf("unexpected %q", fields[1])
+	}
+	for _, item := range strings.Split(fields[0], ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		if !isRange {
+			last = first
+		}
+		from, ok := WEEKDAYS[first]
+		if !ok {
+			return w, fmt.Errorf("unknown weekday %q", first)
+		}
+		to, ok := WEEKDAYS[last]
+		if !ok {
+			return w, fmt.Errorf("unknown weekday %q", last)
+		}
+		// ranges like "fri-mon" wrap over the week end
+		for d := from; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return w, nil
+}
+
+func parseRange(s string) (int, int, error) {
+	a, b, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected time range like 08:00-19:00, got %q", s)
+	}
+	from, err := parseClock(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parseClock(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from == to {
+		return 0, 0, fmt.Errorf("empty time range %q", s)
+	}
+	return from, to, nil
+}
+
+// "24:00" is accepted as the end of the day
+func parseClock(s string) (int, error) {
+	if s == "24:00" {
+		return MINUTES_PER_DAY, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// whether t falls into one of the windows, nil or empty schedule is always active
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil || len(s.windows) == 0 {
+		return true
+	}
+	t = t.In(time.Local)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	for _, w := range s.windows {
+		if w.from < w.to {
+			if w.days[day] && minute >= w.from && minute < w.to {
+				return true
+			}
+			continue
+		}
+		// crossing midnight: evening part belongs to today, morning part to yesterday
+		if w.days[day] && minute >= w.from {
+			return true
+		}
+		if w.days[yesterday] && minute < w.to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func init() {
+	time.Local = time.UTC
+}
+
+// 2024-01-01 is monday
+func at(day int, clock string) time.Time {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2024, 1, day, t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		spec     string
+		expected string
+	}{
+		{"mon-fri 08:00", `window "mon-fri 08:00": expected time range like 08:00-19:00, got "08:00"`},
+		{"mon-fri 08:00-25:00", `window "mon-fri 08:00-25:00": invalid time "25:00", expected HH:MM`},
+		{"10:00-10:00", `window "10:00-10:00": empty time range "10:00-10:00"`},
+		{"monday", `window "monday": unknown weekday "monday"`},
+		{"mon-xyz", `window "mon-xyz": unknown weekday "xyz"`},
+		{"mon tue 08:00-10:00", `window "mon tue 08:00-10:00": expected "<days> <from>-<to>"`},
+		{"mon tue", `window "mon tue": unexpected "tue"`},
+		{"mon |", `window "": expected "<days> <from>-<to>"`},
+	}
+	for _, c := range cases {
+		t.Run(c.spec, func(t *testing.T) {
+			_, err := Parse(c.spec)
+			if err == nil {
+				t.Fatalf("expected error %q", c.expected)
+			}
+			if err.Error() != c.expected {
+				t.Errorf("got %q, expected %q", err, c.expected)
+			}
+		})
+	}
+}
+
+func TestActive(t *testing.T) {
+	cases := []struct {
+		spec     string
+		t        time.Time
+		expected bool
+	}{
+		{"", at(1, "03:00"), true},
+		{"  ", at(1, "03:00"), true},
+		// working hours, end is exclusive
+		{"mon-fri 08:00-19:00", at(1, "08:00"), true},
+		{"mon-fri 08:00-19:00", at(5, "18:59"), true},
+		{"mon-fri 08:00-19:00", at(5, "19:00"), false},
+		{"mon-fri 08:00-19:00", at(1, "07:59"), false},
+		{"mon-fri 08:00-19:00", at(6, "12:00"), false},
+		{"MON-FRI 08:00-19:00", at(3, "12:00"), true},
+		// whole days
+		{"sat,sun", at(6, "00:00"), true},
+		{"sat,sun", at(7, "23:59"), true},
+		{"sat,sun", at(8, "00:00"), false},
+		{"* 10:00-11:00", at(7, "10:30"), true},
+		{"10:00-24:00", at(2, "23:59"), true},
+		// weekday range wrapping over the week end
+		{"fri-mon", at(5, "12:00"), true},
+		{"fri-mon", at(7, "12:00"), true},
+		{"fri-mon", at(8, "12:00"), true},
+		{"fri-mon", at(9, "12:00"), false},
+		{"fri-mon", at(4, "23:59"), false},
+		// range crossing midnight belongs to the day it starts
+		{"22:00-06:00", at(1, "23:00"), true},
+		{"22:00-06:00", at(2, "05:59"), true},
+		{"22:00-06:00", at(2, "06:00"), false},
+		{"22:00-06:00", at(2, "21:59"), false},
+		{"fri 22:00-06:00", at(5, "23:00"), true},
+		{"fri 22:00-06:00", at(6, "05:00"), true},
+		{"fri 22:00-06:00", at(5, "05:00"), false},
+		{"fri 22:00-06:00", at(6, "23:00"), false},
+		{"fri-mon 22:00-06:00", at(9, "03:00"), true},
+		{"fri-mon 22:00-06:00", at(9, "23:00"), false},
+		{"fri-mon 22:00-06:00", at(5, "03:00"), false},
+		// several windows
+		{"mon-fri 08:00-19:00 | sat 10:00-14:00", at(6, "11:00"), true},
+		{"mon-fri 08:00-19:00 | sat 10:00-14:00", at(6, "15:00"), false},
+		{"mon-fri 08:00-19:00 | sat 10:00-14:00", at(2, "09:00"), true},
+	}
+	for _, c := range cases {
+		t.Run(c.spec+" at "+c.t.Format("Mon 15:04"), func(t *testing.T) {
+			s, err := Parse(c.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Active(c.t); got != c.expected {
+				t.Errorf("got %v, expected %v", got, c.expected)
+			}
+		})
+	}
+}
+
+func TestNilIsActive(t *testing.T) {
+	var s *Schedule
+	if !s.Active(time.Now()) {
+		t.Errorf("nil schedule should be always active")
+	}
+}
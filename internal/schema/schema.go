@@ -0,0 +1,182 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// json schema generated with reflection from go types, so it is always in sync with payload structs,
+// field names are taken from json tags, required fields are marked with `jsonschema:"required"` tag,
+// types with custom json encoding should be described with Define()
+
+const DRAFT = "https://json-schema.org/draft/2020-12/schema"
+
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	durationType  = reflect.TypeOf(time.Duration(0))
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+var (
+	definedMu sync.RWMutex
+	defined   = map[reflect.Type]*Schema{}
+	cache     sync.Map
+)
+
+// set schema for the type of v, overriding reflection
+func Define(v any, s *Schema) {
+	definedMu.Lock()
+	defer definedMu.Unlock()
+	defined[reflect.TypeOf(v)] = s
+}
+
+// generate schema for the type of v, result is cached and should not be modified
+func For(v any) *Schema {
+	t := reflect.TypeOf(v)
+	if s, ok := cache.Load(t); ok {
+		return s.(*Schema)
+	}
+	s := forType(t)
+	cache.Store(t, s)
+	return s
+}
+
+func forType(t reflect.Type) *Schema {
+	definedMu.RLock()
+	s, ok := defined[t]
+	definedMu.RUnlock()
+	if ok {
+		return s
+	}
+	if t.Kind() == reflect.Pointer {
+		return forType(t.Elem())
+	}
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case durationType:
+		return &Schema{Type: "integer", Description: "nanoseconds"}
+	}
+	// custom encoding without explicit definition, could be anything
+	if t.Implements(marshalerType) {
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string"}
+		}
+		return &Schema{Type: "array", Items: forType(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: forType(t.Elem())}
+	case reflect.Struct:
+		return structType(t)
+	}
+	return &Schema{}
+}
+
+func structType(t reflect.Type) *Schema {
+	s := &Schema{
+		Type:                 "object",
+		Properties:           map[string]*Schema{},
+		AdditionalProperties: false,
+	}
+	addFields(s, t)
+	return s
+}
+
+// schema of the struct fields, ignoring custom MarshalJSON of the struct itself,
+// to be used as a base for Extend()
+func Fields(v any) *Schema {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return structType(t)
+}
+
+func addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		// embedded struct without explicit name is inlined, same as encoding/json does
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addFields(s, ft)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = forType(f.Type)
+		if strings.Contains(f.Tag.Get("jsonschema"), "required") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// copy of the object schema, which allows properties not described by it,
+// used for inbound payloads, which were accepted with unknown keys before validation was introduced
+func Open(base *Schema) *Schema {
+	s := *base
+	s.AdditionalProperties = nil
+	return &s
+}
+
+// copy of the object schema with extra properties, used to describe types with custom MarshalJSON
+func Extend(base *Schema, props map[string]*Schema) *Schema {
+	s := *base
+	s.Properties = map[string]*Schema{}
+	for k, v := range base.Properties {
+		s.Properties[k] = v
+	}
+	for k, v := range props {
+		s.Properties[k] = v
+	}
+	return &s
+}
+
+// standalone json schema document
+func Document(id string, s *Schema) map[string]any {
+	b, _ := json.Marshal(s)
+	doc := map[string]any{}
+	_ = json.Unmarshal(b, &doc)
+	doc["$schema"] = DRAFT
+	doc["$id"] = id
+	return doc
+}
@@ -0,0 +1,153 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type inner struct {
+	Value int `json:"value" jsonschema:"required"`
+}
+
+type Embedded struct {
+	Shared string `json:"shared"`
+}
+
+type sample struct {
+	Embedded
+	Name     string `json:"name" jsonschema:"required"`
+	Optional string `json:"optional,omitempty"`
+	Untagged bool
+	Skipped  string `json:"-"`
+	hidden   string
+	Ptr      *int              `json:"ptr"`
+	Labels   map[string]string `json:"labels"`
+	Items    []inner           `json:"items"`
+	Raw      []byte            `json:"raw"`
+	Ts       time.Time         `json:"ts"`
+	Timeout  time.Duration     `json:"timeout"`
+	Ratio    float64           `json:"ratio"`
+	Nested   *inner            `json:"nested"`
+}
+
+func TestFor(t *testing.T) {
+	s := For(sample{})
+	if s.Type != "object" || s.AdditionalProperties != false {
+		t.Fatalf("unexpected struct schema %+v", s)
+	}
+	cases := []struct {
+		name     string
+		expected *Schema
+	}{
+		{"shared", &Schema{Type: "string"}},
+		{"name", &Schema{Type: "string"}},
+		{"optional", &Schema{Type: "string"}},
+		{"Untagged", &Schema{Type: "boolean"}},
+		{"ptr", &Schema{Type: "integer"}},
+		{"labels", &Schema{Type: "object", AdditionalProperties: &Schema{Type: "string"}}},
+		{"items", &Schema{Type: "array", Items: &Schema{
+			Type: "object", Properties: map[string]*Schema{"value": {Type: "integer"}}, Required: []string{"value"}, AdditionalProperties: false,
+		}}},
+		{"raw", &Schema{Type: "string"}},
+		{"ts", &Schema{Type: "string", Format: "date-time"}},
+		{"timeout", &Schema{Type: "integer", Description: "nanoseconds"}},
+		{"ratio", &Schema{Type: "number"}},
+		{"nested", &Schema{
+			Type: "object", Properties: map[string]*Schema{"value": {Type: "integer"}}, Required: []string{"value"}, AdditionalProperties: false,
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if !reflect.DeepEqual(s.Properties[c.name], c.expected) {
+				got, _ := json.Marshal(s.Properties[c.name])
+				expected, _ := json.Marshal(c.expected)
+				t.Errorf("got %s, expected %s", got, expected)
+			}
+		})
+	}
+	if len(s.Properties) != len(cases) {
+		t.Errorf("got %d properties, expected %d: %v", len(s.Properties), len(cases), propNames(s))
+	}
+	if !reflect.DeepEqual(s.Required, []string{"name"}) {
+		t.Errorf("got required %v, expected [name]", s.Required)
+	}
+	if For(sample{}) != s {
+		t.Errorf("schema is not cached")
+	}
+}
+
+type custom struct{}
+
+func (custom) MarshalJSON() ([]byte, error) { return []byte(`"custom"`), nil }
+
+func TestDefineAndExtend(t *testing.T) {
+	if s := For(custom{}); !reflect.DeepEqual(s, &Schema{}) {
+		t.Errorf("type with custom encoding should accept anything, got %+v", s)
+	}
+	type defined int
+	Define(defined(0), &Schema{Type: "integer", Enum: []any{1, 2}})
+	if s := For([]defined{}); s.Items.Type != "integer" || len(s.Items.Enum) != 2 {
+		t.Errorf("defined schema is not used, got %+v", s.Items)
+	}
+	base := Fields(inner{})
+	ext := Extend(base, map[string]*Schema{"extra": {Type: "string"}})
+	if len(base.Properties) != 1 || len(ext.Properties) != 2 || ext.Required[0] != "value" {
+		t.Errorf("unexpected extended schema %+v, base %+v", ext, base)
+	}
+	if open := Open(base); open.AdditionalProperties != nil || base.AdditionalProperties != false {
+		t.Errorf("open should not modify base schema")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	item := &Schema{OneOf: []*Schema{{Type: "string"}, Fields(inner{})}}
+	s := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"name":   {Type: "string"},
+			"ratio":  {Type: "number"},
+			"count":  {Type: "integer"},
+			"ts":     {Type: "string", Format: "date-time"},
+			"status": {Type: "integer", Enum: []any{0, 1, 2}},
+			"labels": {Type: "object", AdditionalProperties: &Schema{Type: "string"}},
+			"items":  {Type: "array", Items: item},
+			"nested": Fields(inner{}),
+		},
+		Required:             []string{"name"},
+		AdditionalProperties: false,
+	}
+	cases := []struct {
+		name     string
+		schema   *Schema
+		data     string
+		expected string
+	}{
+		{"valid", s, `{"name":"a","ratio":1,"count":2.0,"ts":"2024-01-01T00:00:00Z","status":1,"labels":{"k":"v"},"items":["10.0.0.1",{"value":1}],"nested":{"value":3}}`, ""},
+		{"invalid json", s, `{"name":`, "$: invalid json: unexpected EOF"},
+		{"missing required", s, `{}`, "$: missing required property name"},
+		{"wrong type", s, `{"name":1}`, "$.name: expected string, got integer"},
+		{"fractional integer", s, `{"name":"a","count":1.5}`, "$.count: expected integer, got number"},
+		{"not in enum", s, `{"name":"a","status":7}`, "$.status: expected one of [0 1 2], got 7"},
+		{"bad date-time", s, `{"name":"a","ts":"yesterday"}`, "$.ts: expected RFC 3339 date-time"},
+		{"map value", s, `{"name":"a","labels":{"k":1}}`, "$.labels.k: expected string, got integer"},
+		{"unknown property", s, `{"name":"a","other":1}`, "$: unexpected property other, expected one of count, items, labels, name, nested, ratio, status, ts"},
+		{"nested required", s, `{"name":"a","nested":{}}`, "$.nested: missing required property value"},
+		{"array item", s, `{"name":"a","items":["ok",{"value":"x"}]}`, "$.items[1]: does not match any of the allowed forms ($.items[1]: expected string, got object; $.items[1].value: expected integer, got string)"},
+		{"null", s, `null`, "$: expected object, got null"},
+		{"open schema", Open(Fields(inner{})), `{"value":1,"other":true}`, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := Validate(c.schema, []byte(c.data))
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != c.expected {
+				t.Errorf("got %q, expected %q", got, c.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package schema
+
+import (
+	"sort"
+
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+// definitions for the shared types with custom json encoding
+
+func init() {
+	statuses := []any{}
+	for status := range workers.STATUS_NAMES {
+		statuses = append(statuses, int(status))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].(int) < statuses[j].(int) })
+	Define(workers.OnlineStatus(0), &Schema{Type: "integer", Enum: statuses, Description: "numeric online status"})
+	Define(workers.UpdSource(0), &Schema{Type: "string", Description: `what triggered the update, like "online checker (id=3)"`})
+	Define(registry.Uptime{}, &Schema{Type: "string", Description: "human readable uptime, like 1h2m3s"})
+	Define(workers.StatusEvent{}, Extend(Fields(workers.StatusEvent{}), map[string]*Schema{
+		"statusName": {Type: "string", Description: "human readable online status"},
+		"rttMs":      {Type: "number", Description: "last round trip time in milliseconds"},
+	}))
+}
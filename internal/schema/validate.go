@@ -0,0 +1,155 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// validator for the subset of json schema produced by this package,
+// errors are reported with json path like "$.targets[1].name: expected string, got number"
+
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+func Validate(s *Schema, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return &ValidationError{"$", "invalid json: " + err.Error()}
+	}
+	return validate(s, v, "$")
+}
+
+func typeOf(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := x.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func validate(s *Schema, v any, path string) error {
+	if len(s.OneOf) > 0 {
+		var errs []string
+		for _, option := range s.OneOf {
+			err := validate(option, v, path)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return &ValidationError{path, "does not match any of the allowed forms (" + strings.Join(errs, "; ") + ")"}
+	}
+	actual := typeOf(v)
+	if s.Type != "" && s.Type != actual && !(s.Type == "number" && actual == "integer") {
+		// integer-valued floats like 1.0 are still integers
+		if !(s.Type == "integer" && actual == "number" && isWhole(v)) {
+			return &ValidationError{path, fmt.Sprintf("expected %s, got %s", s.Type, actual)}
+		}
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+		return &ValidationError{path, fmt.Sprintf("expected one of %v, got %v", s.Enum, v)}
+	}
+	if s.Format == "date-time" {
+		if str, ok := v.(string); ok {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return &ValidationError{path, "expected RFC 3339 date-time"}
+			}
+		}
+	}
+	switch x := v.(type) {
+	case []any:
+		if s.Items != nil {
+			for i, item := range x {
+				if err := validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := x[name]; !ok {
+				return &ValidationError{path, "missing required property " + name}
+			}
+		}
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			prop, ok := s.Properties[k]
+			if !ok {
+				switch ap := s.AdditionalProperties.(type) {
+				case bool:
+					if !ap {
+						return &ValidationError{path, fmt.Sprintf("unexpected property %s, expected one of %s", k, strings.Join(propNames(s), ", "))}
+					}
+					continue
+				case *Schema:
+					prop = ap
+				default:
+					continue
+				}
+			}
+			if err := validate(prop, x[k], path+"."+k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isWhole(v any) bool {
+	n, ok := v.(json.Number)
+	if !ok {
+		return false
+	}
+	f, err := n.Float64()
+	return err == nil && f == math.Trunc(f)
+}
+
+func inEnum(enum []any, v any) bool {
+	if n, ok := v.(json.Number); ok {
+		f, _ := n.Float64()
+		return slices.ContainsFunc(enum, func(e any) bool {
+			return fmt.Sprint(e) == fmt.Sprint(f) || fmt.Sprint(e) == n.String()
+		})
+	}
+	return slices.ContainsFunc(enum, func(e any) bool { return e == v })
+}
+
+func propNames(s *Schema) []string {
+	names := make([]string, 0, len(s.Properties))
+	for k := range s.Properties {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,112 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/logger"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/mhz19-go/pkg/utils"
+)
+
+// runtime state, which should survive restarts, is kept in memory and
+// written to PINGER_STATE_FILE on every change, empty file name disables persistence
+
+var tagBase = utils.NewTag(logger.TAG_STAT)
+
+type fileData struct {
+	Paused []string `json:"paused"`
+}
+
+var (
+	mu     sync.RWMutex
+	paused = map[string]bool{}
+)
+
+func init() {
+	load()
+}
+
+func load() {
+	fileName := registry.Config.StateFile
+	if fileName == "" {
+		return
+	}
+	b, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	data := fileData{}
+	if err == nil {
+		err = json.Unmarshal(b, &data)
+	}
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to load state, starting with empty one"), "file", fileName, "err", err)
+		return
+	}
+	for _, target := range data.Paused {
+		paused[target] = true
+	}
+	slog.Info(tagBase.F("Loaded"), "file", fileName, "paused", len(paused))
+}
+
+// write to temporary file and rename, so state file is never left half-written
+func save_unsafe() error {
+	fileName := registry.Config.StateFile
+	if fileName == "" {
+		return nil
+	}
+	data := fileData{Paused: make([]string, 0, len(paused))}
+	for target := range paused {
+		data.Paused = append(data.Paused, target)
+	}
+	sort.Strings(data.Paused)
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+func IsPaused(target string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return paused[target]
+}
+
+// failure to persist is logged and reported, in-memory state is updated anyway
+func SetPaused(target string, value bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if paused[target] == value {
+		return
+	}
+	if value {
+		paused[target] = true
+	} else {
+		delete(paused, target)
+	}
+	if err := save_unsafe(); err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to save state"), "file", registry.Config.StateFile, "err", err)
+	}
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+// streaming export of raw events or ping samples, rows are written as they are read from database,
+// so memory usage does not depend on the size of the exported range
+
+const (
+	FORMAT_CSV   = "csv"
+	FORMAT_JSONL = "jsonl"
+	KIND_EVENTS  = "events"
+	KIND_SAMPLES = "samples"
+	FLUSH_EVERY  = 1000
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown export format")
+	ErrUnknownKind   = errors.New("unknown export kind")
+)
+
+var (
+	CSV_HEADER         = []string{"ts", "target", "name", "status", "status_name", "upd_source", "rtt_ms"}
+	SAMPLES_CSV_HEADER = []string{"ts", "target", "name", "status", "status_name", "rtt_ms", "loss"}
+)
+
+// empty targets list means all targets, zero times mean no restriction, empty kind means events
+type ExportQuery struct {
+	Kind    string
+	Targets []workers.TargetAddr
+	From    time.Time
+	To      time.Time
+}
+
+// exported row, either Event or Sample
+type row interface {
+	csv() []string
+}
+
+func ContentType(format string) string {
+	if format == FORMAT_CSV {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+func CheckFormat(format string) error {
+	if format != FORMAT_CSV && format != FORMAT_JSONL {
+		return fmt.Errorf("%w %q, expected %s or %s", ErrUnknownFormat, format, FORMAT_CSV, FORMAT_JSONL)
+	}
+	return nil
+}
+
+func CheckKind(kind string) error {
+	if kind != "" && kind != KIND_EVENTS && kind != KIND_SAMPLES {
+		return fmt.Errorf("%w %q, expected %s or %s", ErrUnknownKind, kind, KIND_EVENTS, KIND_SAMPLES)
+	}
+	return nil
+}
+
+func (e Event) csv() []string {
+	return []string{
+		e.Ts.Format(time.RFC3339Nano),
+		string(e.Target),
+		e.Name,
+		strconv.Itoa(int(e.Status)),
+		workers.STATUS_NAMES[e.Status],
+		workers.UPD_SOURCE_NAMES[e.UpdSource],
+		strconv.FormatFloat(e.RttMs, 'f', -1, 64),
+	}
+}
+
+func (s Sample) csv() []string {
+	return []string{
+		s.Ts.Format(time.RFC3339Nano),
+		string(s.Target),
+		s.Name,
+		strconv.Itoa(int(s.Status)),
+		workers.STATUS_NAMES[s.Status],
+		strconv.FormatFloat(s.RttMs, 'f', -1, 64),
+		strconv.FormatFloat(s.Loss, 'f', -1, 64),
+	}
+}
+
+type encoder interface {
+	encode(r row) error
+	flush() error
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func (c csvEncoder) encode(r row) error {
+	return c.w.Write(r.csv())
+}
+
+func (c csvEncoder) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlEncoder struct {
+	enc *json.Encoder
+}
+
+func (j jsonlEncoder) encode(r row) error {
+	return j.enc.Encode(r)
+}
+
+func (j jsonlEncoder) flush() error {
+	return nil
+}
+
+// write events or samples ordered from oldest to newest, when w implements Flush() (like http.ResponseWriter)
+// it is flushed every FLUSH_EVERY rows, returns number of written rows
+func Export(w io.Writer, format string, q ExportQuery) (int, error) {
+	if db == nil {
+		return 0, ErrDisabled
+	}
+	if err := CheckFormat(format); err != nil {
+		return 0, err
+	}
+	if err := CheckKind(q.Kind); err != nil {
+		return 0, err
+	}
+	query, header, scan := "SELECT "+EVENT_COLUMNS+" FROM events", CSV_HEADER, func(rows *sql.Rows) (row, error) {
+		return scanEvent(rows)
+	}
+	if q.Kind == KIND_SAMPLES {
+		query, header, scan = "SELECT "+SAMPLE_COLUMNS+" FROM samples", SAMPLES_CSV_HEADER, func(rows *sql.Rows) (row, error) {
+			return scanSample(rows)
+		}
+	}
+	wh := &where{}
+	if len(q.Targets) > 0 {
+		placeholders := make([]string, len(q.Targets))
+		for i, t := range q.Targets {
+			placeholders[i] = "?"
+			wh.args = append(wh.args, string(t))
+		}
+		wh.conds = append(wh.conds, "target IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if !q.From.IsZero() {
+		wh.add("ts >= ?", q.From.UnixMilli())
+	}
+	if !q.To.IsZero() {
+		wh.add("ts <= ?", q.To.UnixMilli())
+	}
+	rows, err := db.Query(query+wh.String()+" ORDER BY ts, id", wh.args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var enc encoder = jsonlEncoder{json.NewEncoder(w)}
+	if format == FORMAT_CSV {
+		cw := csv.NewWriter(w)
+		if err := cw.Write(header); err != nil {
+			return 0, err
+		}
+		enc = csvEncoder{cw}
+	}
+	flusher, _ := w.(interface{ Flush() })
+	count := 0
+	for rows.Next() {
+		r, err := scan(rows)
+		if err != nil {
+			return count, err
+		}
+		if err := enc.encode(r); err != nil {
+			return count, err
+		}
+		count++
+		if count%FLUSH_EVERY == 0 {
+			if err := enc.flush(); err != nil {
+				return count, err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	return count, enc.flush()
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+type Event struct {
+	Ts        time.Time            `json:"ts"`
+	Target    workers.TargetAddr   `json:"target"`
+	Name      string               `json:"name,omitempty"`
+	Status    workers.OnlineStatus `json:"status"`
+	UpdSource workers.UpdSource    `json:"updSource"`
+	RttMs     float64              `json:"rttMs"`
+	// labels of the target at the time of the event
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type Sample struct {
+	Ts     time.Time            `json:"ts"`
+	Target workers.TargetAddr   `json:"target"`
+	Name   string               `json:"name,omitempty"`
+	Status workers.OnlineStatus `json:"status"`
+	// zero for loss samples of silent target
+	RttMs float64 `json:"rttMs"`
+	// percent of echo requests lost since the previous sample
+	Loss float64 `json:"loss"`
+}
+
+type Daily struct {
+	Day                string             `json:"day"`
+	Target             workers.TargetAddr `json:"target"`
+	Name               string             `json:"name,omitempty"`
+	OnlineSeconds      float64            `json:"onlineSeconds"`
+	OfflineSeconds     float64            `json:"offlineSeconds"`
+	UnreachableSeconds float64            `json:"unreachableSeconds"`
+	OtherSeconds       float64            `json:"otherSeconds"`
+	Transitions        int                `json:"transitions"`
+	Events             int                `json:"events"`
+	RttAvgMs           float64            `json:"rttAvgMs"`
+}
+
+// zero values mean no restriction, limit keeps the most recent events
+type EventsQuery struct {
+	Target workers.TargetAddr
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// days are in "2006-01-02" format, both ends are inclusive
+type DailyQuery struct {
+	Target workers.TargetAddr
+	From   string
+	To     string
+}
+
+type where struct {
+	conds []string
+	args  []any
+}
+
+func (w *where) add(cond string, arg any) {
+	w.conds = append(w.conds, cond)
+	w.args = append(w.args, arg)
+}
+
+func (w *where) String() string {
+	if len(w.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conds, " AND ")
+}
+
+const EVENT_COLUMNS = "ts, target, name, status, upd_source, rtt_ms, labels"
+
+func scanEvent(rows *sql.Rows) (Event, error) {
+	e := Event{}
+	var ts int64
+	var labels string
+	if err := rows.Scan(&ts, &e.Target, &e.Name, &e.Status, &e.UpdSource, &e.RttMs, &labels); err != nil {
+		return e, err
+	}
+	e.Ts = time.UnixMilli(ts)
+	if labels != "" {
+		if err := json.Unmarshal([]byte(labels), &e.Labels); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+const SAMPLE_COLUMNS = "ts, target, name, status, rtt_ms, loss"
+
+func scanSample(rows *sql.Rows) (Sample, error) {
+	s := Sample{}
+	var ts int64
+	if err := rows.Scan(&ts, &s.Target, &s.Name, &s.Status, &s.RttMs, &s.Loss); err != nil {
+		return s, err
+	}
+	s.Ts = time.UnixMilli(ts)
+	return s, nil
+}
+
+// raw events ordered from oldest to newest
+func Events(q EventsQuery) ([]Event, error) {
+	if db == nil {
+		return nil, ErrDisabled
+	}
+	w := &where{}
+	if q.Target != "" {
+		w.add("target = ?", string(q.Target))
+	}
+	if !q.From.IsZero() {
+		w.add("ts >= ?", q.From.UnixMilli())
+	}
+	if !q.To.IsZero() {
+		w.add("ts <= ?", q.To.UnixMilli())
+	}
+	query := "SELECT " + EVENT_COLUMNS + " FROM events" + w.String() + " ORDER BY ts DESC, id DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		w.args = append(w.args, q.Limit)
+	}
+	rows, err := db.Query(query, w.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []Event{}
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res, nil
+}
+
+// daily rollups ordered by day and target, current day is not included until it is completed
+func DailyRollups(q DailyQuery) ([]Daily, error) {
+	if db == nil {
+		return nil, ErrDisabled
+	}
+	w := &where{}
+	if q.Target != "" {
+		w.add("target = ?", string(q.Target))
+	}
+	if q.From != "" {
+		w.add("day >= ?", q.From)
+	}
+	if q.To != "" {
+		w.add("day <= ?", q.To)
+	}
+	rows, err := db.Query(
+		`SELECT day, target, name, online_seconds, offline_seconds, unreachable_seconds, other_seconds, transitions, events, rtt_avg_ms
+		FROM daily`+w.String()+` ORDER BY day, target`,
+		w.args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []Daily{}
+	for rows.Next() {
+		d := Daily{}
+		err := rows.Scan(
+			&d.Day, &d.Target, &d.Name,
+			&d.OnlineSeconds, &d.OfflineSeconds, &d.UnreachableSeconds, &d.OtherSeconds,
+			&d.Transitions, &d.Events, &d.RttAvgMs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+// status periods of the target within the range, ordered from oldest to newest,
+// status of an event lasts until the next event, but not longer than two periodic updates (same as in rollups)
+func Periods(target workers.TargetAddr, from time.Time, to time.Time) ([]workers.Period, error) {
+	if db == nil {
+		return nil, ErrDisabled
+	}
+	rows, err := db.Query(
+		`SELECT ts, status FROM events WHERE target = ? AND ts >= ? AND ts < ? ORDER BY ts, id`,
+		string(target),
+		from.Add(-maxGap()).UnixMilli(),
+		to.UnixMilli(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []workers.Period{}
+	for rows.Next() {
+		var ts int64
+		var status workers.OnlineStatus
+		if err := rows.Scan(&ts, &status); err != nil {
+			return nil, err
+		}
+		start := time.UnixMilli(ts)
+		if n := len(res); n > 0 && res[n-1].To.After(start) {
+			res[n-1].To = start
+		}
+		res = append(res, workers.Period{From: start, To: start.Add(maxGap()), Status: status})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range res {
+		if res[i].From.Before(from) {
+			res[i].From = from
+		}
+		if res[i].To.After(to) {
+			res[i].To = to
+		}
+	}
+	return res, nil
+}
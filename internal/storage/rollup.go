@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+// completed days (in local time zone) are rolled up into the daily table once,
+// raw events are pruned only after their day was rolled up
+
+const (
+	DAY_FORMAT        = "2006-01-02"
+	META_ROLLED_UNTIL = "rolled_up_until" // first day which is not rolled up yet
+)
+
+type rawEvent struct {
+	ts     time.Time
+	target string
+	name   string
+	status workers.OnlineStatus
+	rttMs  float64
+}
+
+type dayTotals struct {
+	name        string
+	seconds     map[workers.OnlineStatus]float64
+	transitions int
+	events      int
+	rttSum      float64
+	rttCount    int
+}
+
+func maintainer() {
+	defer wg.Done()
+	maintain()
+	ticker := time.NewTicker(MAINTENANCE)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			maintain()
+		}
+	}
+}
+
+func maintain() {
+	now := time.Now()
+	if err := rollup(now); err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to roll up events"), "err", err)
+		return
+	}
+	if err := prune(now); err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to prune old data"), "err", err)
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.In(time.Local).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// status of the event is assumed to last until the next event, but not longer than two periodic updates,
+// since periodic updates are sent even when nothing changes, longer gap means application was not running
+func maxGap() time.Duration {
+	return 2 * registry.Config.PeriodicUpdateInterval
+}
+
+func rolledUntil() (time.Time, error) {
+	var value string
+	err := db.QueryRow(`SELECT value FROM meta WHERE key = ?`, META_ROLLED_UNTIL).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		// nothing was rolled up yet, start from the oldest event
+		var minTs sql.NullInt64
+		if err := db.QueryRow(`SELECT MIN(ts) FROM events`).Scan(&minTs); err != nil {
+			return time.Time{}, err
+		}
+		if !minTs.Valid {
+			return startOfDay(time.Now()), nil
+		}
+		return startOfDay(time.UnixMilli(minTs.Int64)), nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation(DAY_FORMAT, value, time.Local)
+}
+
+func rollup(now time.Time) error {
+	day, err := rolledUntil()
+	if err != nil {
+		return err
+	}
+	today := startOfDay(now)
+	for day.Before(today) {
+		next := day.AddDate(0, 0, 1)
+		if err := rollupDay(day, next); err != nil {
+			return err
+		}
+		slog.Debug(tagBase.F("Rolled up"), "day", day.Format(DAY_FORMAT))
+		day = next
+	}
+	return nil
+}
+
+func rollupDay(start time.Time, end time.Time) error {
+	rows, err := db.Query(
+		`SELECT ts, target, name, status, rtt_ms FROM events WHERE ts >= ? AND ts < ? ORDER BY target, ts, id`,
+		start.Add(-maxGap()).UnixMilli(),
+		end.UnixMilli(),
+	)
+	if err != nil {
+		return err
+	}
+	byTarget := map[string][]rawEvent{}
+	targets := []string{}
+	for rows.Next() {
+		e := rawEvent{}
+		var ts int64
+		if err := rows.Scan(&ts, &e.target, &e.name, &e.status, &e.rttMs); err != nil {
+			rows.Close()
+			return err
+		}
+		e.ts = time.UnixMilli(ts)
+		if _, ok := byTarget[e.target]; !ok {
+			targets = append(targets, e.target)
+		}
+		byTarget[e.target] = append(byTarget[e.target], e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	dayLength := end.Sub(start).Seconds()
+	for _, target := range targets {
+		t := totals(byTarget[target], start, end)
+		known := t.seconds[workers.STATUS_ONLINE] + t.seconds[workers.STATUS_OFFLINE] + t.seconds[workers.STATUS_UNREACHABLE]
+		// target was deleted before the day started
+		if t.events == 0 && known == 0 {
+			continue
+		}
+		rttAvg := 0.0
+		if t.rttCount > 0 {
+			rttAvg = t.rttSum / float64(t.rttCount)
+		}
+		_, err := tx.Exec(
+			`INSERT OR REPLACE INTO daily (day, target, name, online_seconds, offline_seconds, unreachable_seconds, other_seconds, transitions, events, rtt_avg_ms)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			start.Format(DAY_FORMAT),
+			target,
+			t.name,
+			t.seconds[workers.STATUS_ONLINE],
+			t.seconds[workers.STATUS_OFFLINE],
+			t.seconds[workers.STATUS_UNREACHABLE],
+			dayLength-known,
+			t.transitions,
+			t.events,
+			rttAvg,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(
+		`INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)`,
+		META_ROLLED_UNTIL,
+		end.Format(DAY_FORMAT),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// events should be ordered by time, the ones before start give the status at the beginning of the day
+func totals(events []rawEvent, start time.Time, end time.Time) dayTotals {
+	t := dayTotals{seconds: map[workers.OnlineStatus]float64{}}
+	var prev *rawEvent
+	for i := range events {
+		e := &events[i]
+		if !e.ts.Before(start) {
+			t.events++
+			if prev != nil && prev.status != e.status {
+				t.transitions++
+			}
+			if e.status == workers.STATUS_ONLINE && e.rttMs > 0 {
+				t.rttSum += e.rttMs
+				t.rttCount++
+			}
+		}
+		if e.name != "" {
+			t.name = e.name
+		}
+		segEnd := e.ts.Add(maxGap())
+		if i+1 < len(events) && events[i+1].ts.Before(segEnd) {
+			segEnd = events[i+1].ts
+		}
+		if segEnd.After(end) {
+			segEnd = end
+		}
+		segStart := e.ts
+		if segStart.Before(start) {
+			segStart = start
+		}
+		if segEnd.After(segStart) {
+			t.seconds[e.status] += segEnd.Sub(segStart).Seconds()
+		}
+		prev = e
+	}
+	return t
+}
+
+func prune(now time.Time) error {
+	if retention := registry.Config.DbRetention; retention > 0 {
+		cutoff := now.Add(-retention)
+		// keep events of the days, which are not rolled up yet
+		until, err := rolledUntil()
+		if err != nil {
+			return err
+		}
+		if until.Before(cutoff) {
+			cutoff = until
+		}
+		res, err := db.Exec(`DELETE FROM events WHERE ts < ?`, cutoff.UnixMilli())
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			slog.Info(tagBase.F("Pruned raw events"), "count", n)
+		}
+	}
+	if retention := registry.Config.DbSamplesRetention; retention > 0 {
+		res, err := db.Exec(`DELETE FROM samples WHERE ts < ?`, now.Add(-retention).UnixMilli())
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			slog.Info(tagBase.F("Pruned ping samples"), "count", n)
+		}
+	}
+	if retention := registry.Config.DbRollupRetention; retention > 0 {
+		cutoff := startOfDay(now.Add(-retention)).Format(DAY_FORMAT)
+		res, err := db.Exec(`DELETE FROM daily WHERE day < ?`, cutoff)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			slog.Info(tagBase.F("Pruned daily rollups"), "count", n)
+		}
+	}
+	return nil
+}
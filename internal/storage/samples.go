@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+// ping samples (every reply and loss samples of silent target) are much more numerous than status events,
+// so they are recorded only when PINGER_DB_SAMPLES is enabled, are not rolled up and have own retention
+
+func SamplesEnabled() bool {
+	return samplesQueue != nil
+}
+
+// ping sample sink, samples are queued and written in batches by separate goroutine
+var SendPing workers.PingHandler = func(sample workers.PingSample) {
+	if samplesQueue == nil {
+		return
+	}
+	select {
+	case samplesQueue <- sample:
+	default:
+		counters.StorageDropped.Inc()
+	}
+}
+
+func insertSamples(batch []workers.PingSample) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	stmt, err := tx.Prepare(`INSERT INTO samples (ts, target, name, status, rtt_ms, loss) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, s := range batch {
+		_, err := stmt.Exec(
+			s.Ts.UnixMilli(),
+			string(s.Target),
+			s.Name,
+			int(s.Status),
+			float64(s.Rtt.Microseconds())/1000,
+			s.Loss,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	counters.StorageWritten.Add(float64(len(batch)))
+	return nil
+}
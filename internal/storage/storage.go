@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/logger"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+	"github.com/fedulovivan/mhz19-go/pkg/utils"
+
+	_ "modernc.org/sqlite"
+)
+
+// optional durable log of status events in local sqlite file (PINGER_DB_FILE),
+// raw events are kept for PINGER_DB_RETENTION and rolled up into daily per-target
+// summaries, which are kept for PINGER_DB_ROLLUP_RETENTION (forever by default).
+// with PINGER_DB_SAMPLES every ping reply is also written to samples table,
+// which is kept for PINGER_DB_SAMPLES_RETENTION
+
+const (
+	QUEUE_SIZE  = 1024
+	BATCH_SIZE  = 100
+	MAINTENANCE = time.Hour
+	MAX_CONNS   = 4
+)
+
+var ErrDisabled = errors.New("storage is disabled")
+
+var tagBase = utils.NewTag(logger.TAG_STOR)
+
+var (
+	db           *sql.DB
+	queue        chan workers.StatusEvent
+	samplesQueue chan workers.PingSample
+	wg           sync.WaitGroup
+	stop         chan struct{}
+)
+
+const SCHEMA = `
+CREATE TABLE IF NOT EXISTS events (
+	id INTEGER PRIMARY KEY,
+	ts INTEGER NOT NULL,
+	target TEXT NOT NULL,
+	name TEXT NOT NULL DEFAULT '',
+	status INTEGER NOT NULL,
+	upd_source INTEGER NOT NULL,
+	rtt_ms REAL NOT NULL DEFAULT 0,
+	labels TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS events_target_ts ON events (target, ts);
+CREATE INDEX IF NOT EXISTS events_ts ON events (ts);
+CREATE TABLE IF NOT EXISTS samples (
+	id INTEGER PRIMARY KEY,
+	ts INTEGER NOT NULL,
+	target TEXT NOT NULL,
+	name TEXT NOT NULL DEFAULT '',
+	status INTEGER NOT NULL,
+	rtt_ms REAL NOT NULL DEFAULT 0,
+	loss REAL NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS samples_target_ts ON samples (target, ts);
+CREATE INDEX IF NOT EXISTS samples_ts ON samples (ts);
+CREATE TABLE IF NOT EXISTS daily (
+	day TEXT NOT NULL,
+	target TEXT NOT NULL,
+	name TEXT NOT NULL DEFAULT '',
+	online_seconds REAL NOT NULL,
+	offline_seconds REAL NOT NULL,
+	unreachable_seconds REAL NOT NULL,
+	other_seconds REAL NOT NULL,
+	transitions INTEGER NOT NULL,
+	events INTEGER NOT NULL,
+	rtt_avg_ms REAL NOT NULL,
+	PRIMARY KEY (day, target)
+);
+CREATE TABLE IF NOT EXISTS meta (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+`
+
+// columns added after the first release, databases created earlier are altered on open
+var MIGRATIONS = []struct {
+	table  string
+	column string
+	ddl    string
+}{
+	{"events", "labels", `ALTER TABLE events ADD COLUMN labels TEXT NOT NULL DEFAULT ''`},
+}
+
+func migrate() error {
+	for _, m := range MIGRATIONS {
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, m.table, m.column).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := db.Exec(m.ddl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Enabled() bool {
+	return db != nil
+}
+
+// open database and start writer and maintenance goroutines, no-op when PINGER_DB_FILE is empty
+func Open() {
+	fileName := registry.Config.DbFile
+	if fileName == "" {
+		slog.Info(tagBase.F("Storage is disabled"))
+		return
+	}
+	if err := OpenFile(fileName); err != nil {
+		panic("failed to open storage: " + err.Error())
+	}
+	queue = make(chan workers.StatusEvent, QUEUE_SIZE)
+	stop = make(chan struct{})
+	wg.Add(2)
+	go writer(queue, insert, "events")
+	go maintainer()
+	if registry.Config.DbSamples {
+		samplesQueue = make(chan workers.PingSample, QUEUE_SIZE)
+		wg.Add(1)
+		go writer(samplesQueue, insertSamples, "samples")
+	}
+	slog.Info(tagBase.F("Opened"), "file", fileName, "samples", registry.Config.DbSamples)
+}
+
+// open database only, without writer and maintenance, for offline tools like export command
+func OpenFile(fileName string) error {
+	var err error
+	db, err = sql.Open("sqlite", fileName+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err == nil {
+		_, err = db.Exec(SCHEMA)
+	}
+	if err == nil {
+		err = migrate()
+	}
+	if err != nil {
+		db = nil
+		return err
+	}
+	// sqlite allows single writer anyway, few more connections let long reads (like export) run along with writer
+	db.SetMaxOpenConns(MAX_CONNS)
+	return nil
+}
+
+// flush queued events and close database
+func Close() {
+	if db == nil {
+		return
+	}
+	if queue != nil {
+		close(stop)
+		close(queue)
+		if samplesQueue != nil {
+			close(samplesQueue)
+		}
+		wg.Wait()
+	}
+	if err := db.Close(); err != nil {
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Failed to close"), "err", err)
+	}
+}
+
+// status change sink, events are queued and written in batches by separate goroutine
+var SendStatus workers.OnlineStatusChangeHandler = func(event workers.StatusEvent) {
+	if db == nil {
+		return
+	}
+	select {
+	case queue <- event:
+	default:
+		counters.StorageDropped.Inc()
+	}
+}
+
+// batch writer, shared by events and ping samples
+func writer[T any](queue chan T, insert func([]T) error, what string) {
+	defer wg.Done()
+	batch := make([]T, 0, BATCH_SIZE)
+	for item := range queue {
+		batch = append(batch[:0], item)
+		// drain whatever is already queued to write it in single transaction
+	drain:
+		for len(batch) < BATCH_SIZE {
+			select {
+			case e, ok := <-queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, e)
+			default:
+				break drain
+			}
+		}
+		if err := insert(batch); err != nil {
+			counters.Errors.Inc()
+			slog.Error(tagBase.F("Failed to write "+what), "count", len(batch), "err", err)
+		}
+	}
+}
+
+func insert(batch []workers.StatusEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	stmt, err := tx.Prepare(`INSERT INTO events (ts, target, name, status, upd_source, rtt_ms, labels) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range batch {
+		labels := ""
+		if len(e.Labels) > 0 {
+			b, err := json.Marshal(e.Labels)
+			if err != nil {
+				return err
+			}
+			labels = string(b)
+		}
+		_, err := stmt.Exec(
+			e.Ts.UnixMilli(),
+			string(e.Target),
+			e.Name,
+			int(e.Status),
+			int(e.UpdSource),
+			float64(e.Rtt.Microseconds())/1000,
+			labels,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	counters.StorageWritten.Add(float64(len(batch)))
+	return nil
+}
@@ -0,0 +1,346 @@
+package summary
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/logger"
+	"github.com/fedulovivan/device-pinger/internal/mqtt"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/storage"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+	"github.com/fedulovivan/mhz19-go/pkg/utils"
+)
+
+// once a day, at PINGER_SUMMARY_TIME (local time, see TZ), presence summary for the past day
+// is published for every target to <base>/<ip>/summary and for every group to <base>/group/<name>/summary.
+// group is a set of targets with the same value of PINGER_SUMMARY_GROUP_LABEL label,
+// group is online while at least one of its members is online.
+// arrival is a change from OFFLINE to ONLINE and departure is the opposite one,
+// changes from or to other statuses (like UNKNOWN after restart or UNREACHABLE) are not counted.
+
+const GROUP_TOPIC_PREFIX = "group/"
+
+var tagBase = utils.NewTag(logger.TAG_SUMM)
+
+type Summary struct {
+	Target  workers.TargetAddr   `json:"target,omitempty"`
+	Name    string               `json:"name,omitempty"`
+	Group   string               `json:"group,omitempty"`
+	Members []workers.TargetAddr `json:"members,omitempty"`
+	From    time.Time            `json:"from"`
+	To      time.Time            `json:"to"`
+	// omitted when target was not seen online during the period
+	FirstSeen     *time.Time `json:"firstSeen,omitempty"`
+	LastSeen      *time.Time `json:"lastSeen,omitempty"`
+	OnlineSeconds float64    `json:"onlineSeconds"`
+	Arrivals      int        `json:"arrivals"`
+	Departures    int        `json:"departures"`
+	// whether target is online at the end of the period
+	Online bool `json:"online"`
+}
+
+// presence accumulated since the start of the current period
+type tracker struct {
+	status        workers.OnlineStatus
+	since         time.Time // start of the current online period
+	firstSeen     time.Time
+	lastSeen      time.Time
+	onlineSeconds float64
+	arrivals      int
+	departures    int
+}
+
+type target struct {
+	tracker
+	name    string
+	group   string
+	deleted bool
+}
+
+var (
+	lock        sync.Mutex
+	periodStart time.Time
+	targets     = map[workers.TargetAddr]*target{}
+	groups      = map[string]*tracker{}
+	at          int // minutes since local midnight, -1 when disabled
+)
+
+func init() {
+	at = -1
+	if registry.Config.SummaryTime == "" {
+		return
+	}
+	t, err := time.Parse("15:04", registry.Config.SummaryTime)
+	if err != nil {
+		panic("invalid PINGER_SUMMARY_TIME, expected HH:MM: " + err.Error())
+	}
+	at = t.Hour()*60 + t.Minute()
+}
+
+func Enabled() bool {
+	return at >= 0
+}
+
+func newTracker() *tracker {
+	return &tracker{status: workers.STATUS_UNKNOWN}
+}
+
+func (t *tracker) observe(status workers.OnlineStatus, lastSeen time.Time, now time.Time) {
+	wasOnline := t.status == workers.STATUS_ONLINE
+	isOnline := status == workers.STATUS_ONLINE
+	switch {
+	case isOnline && !wasOnline:
+		t.since = now
+		if t.firstSeen.IsZero() {
+			t.firstSeen = now
+		}
+		if t.status == workers.STATUS_OFFLINE {
+			t.arrivals++
+		}
+	case !isOnline && wasOnline:
+		t.onlineSeconds += now.Sub(t.since).Seconds()
+		if status == workers.STATUS_OFFLINE {
+			t.departures++
+		}
+	}
+	// last reply time is more precise, than the time of the event
+	if isOnline || wasOnline {
+		if lastSeen.IsZero() || lastSeen.Before(periodStart) || lastSeen.After(now) {
+			lastSeen = now
+		}
+		if lastSeen.After(t.lastSeen) {
+			t.lastSeen = lastSeen
+		}
+	}
+	t.status = status
+}
+
+// close the period and return the summary, tracker is reset for the next period
+func (t *tracker) close(to time.Time) Summary {
+	s := Summary{From: periodStart, To: to, Online: t.status == workers.STATUS_ONLINE}
+	if s.Online {
+		t.onlineSeconds += to.Sub(t.since).Seconds()
+		t.lastSeen = to
+		t.since = to
+	}
+	if !t.firstSeen.IsZero() {
+		firstSeen, lastSeen := t.firstSeen, t.lastSeen
+		s.FirstSeen, s.LastSeen = &firstSeen, &lastSeen
+	}
+	s.OnlineSeconds = t.onlineSeconds
+	s.Arrivals = t.arrivals
+	s.Departures = t.departures
+	*t = tracker{status: t.status, since: t.since}
+	if s.Online {
+		t.firstSeen = to
+		t.lastSeen = to
+	}
+	return s
+}
+
+// group status is ONLINE when any member is online, OFFLINE when any member is offline
+// and UNKNOWN otherwise
+func group_status_unsafe(group string) workers.OnlineStatus {
+	res := workers.STATUS_UNKNOWN
+	for _, t := range targets {
+		if t.group != group || t.deleted {
+			continue
+		}
+		if t.status == workers.STATUS_ONLINE {
+			return workers.STATUS_ONLINE
+		}
+		if t.status == workers.STATUS_OFFLINE {
+			res = workers.STATUS_OFFLINE
+		}
+	}
+	return res
+}
+
+func update_group_unsafe(group string, lastSeen time.Time, now time.Time) {
+	if group == "" {
+		return
+	}
+	g, ok := groups[group]
+	if !ok {
+		g = newTracker()
+		groups[group] = g
+	}
+	g.observe(group_status_unsafe(group), lastSeen, now)
+}
+
+// status change handler, accumulates presence of the current period
+var SendStatus workers.OnlineStatusChangeHandler = func(event workers.StatusEvent) {
+	lock.Lock()
+	defer lock.Unlock()
+	observe_unsafe(event)
+}
+
+func observe_unsafe(event workers.StatusEvent) {
+	now := event.Ts
+	t, ok := targets[event.Target]
+	if !ok {
+		t = &target{tracker: *newTracker()}
+		targets[event.Target] = t
+	}
+	group := event.Labels[registry.Config.SummaryGroupLabel]
+	prevGroup := t.group
+	t.name = event.Name
+	t.group = group
+	t.deleted = event.UpdSource == workers.UPD_SOURCE_WORKER_STOP
+	t.observe(event.Status, event.LastSeen, now)
+	// target has left the group
+	if prevGroup != group {
+		update_group_unsafe(prevGroup, event.LastSeen, now)
+	}
+	update_group_unsafe(group, event.LastSeen, now)
+}
+
+// summaries of all targets and groups for the period ending now
+func collect(now time.Time) (res []Summary) {
+	lock.Lock()
+	defer lock.Unlock()
+	members := map[string][]workers.TargetAddr{}
+	for addr, t := range targets {
+		s := t.close(now)
+		s.Target = addr
+		s.Name = t.name
+		s.Group = t.group
+		res = append(res, s)
+		if t.group != "" && !t.deleted {
+			members[t.group] = append(members[t.group], addr)
+		}
+		// deleted target is reported for the last time
+		if t.deleted {
+			delete(targets, addr)
+		}
+	}
+	for name, g := range groups {
+		s := g.close(now)
+		s.Group = name
+		s.Members = members[name]
+		sort.Slice(s.Members, func(i, j int) bool { return s.Members[i] < s.Members[j] })
+		res = append(res, s)
+		if len(s.Members) == 0 {
+			delete(groups, name)
+		}
+	}
+	periodStart = now
+	return res
+}
+
+func publish(now time.Time) {
+	summaries := collect(now)
+	for _, s := range summaries {
+		topicTarget := s.Target
+		if topicTarget == "" {
+			topicTarget = workers.TargetAddr(GROUP_TOPIC_PREFIX + s.Group)
+		}
+		if err := mqtt.Publish(topicTarget, "summary", s); err != nil {
+			counters.Errors.Inc()
+			slog.Error(tagBase.F("Failed to publish summary"), "target", topicTarget, "err", err)
+		}
+	}
+	slog.Info(tagBase.F("Published"), "count", len(summaries))
+}
+
+// next occurrence of the summary time in local time zone
+func next(now time.Time) time.Time {
+	now = now.In(time.Local)
+	y, m, d := now.Date()
+	res := time.Date(y, m, d, at/60, at%60, 0, 0, time.Local)
+	if !res.After(now) {
+		res = time.Date(y, m, d+1, at/60, at%60, 0, 0, time.Local)
+	}
+	return res
+}
+
+// previous occurrence of the summary time, start of the current period
+func prev(now time.Time) time.Time {
+	y, m, d := next(now).Date()
+	return time.Date(y, m, d-1, at/60, at%60, 0, 0, time.Local)
+}
+
+// replay events of the current period from the event log, so presence accumulated before restart is kept.
+// application is not running between the last event of the target and restart, so targets which were not stopped
+// gracefully are stopped at the last event plus two periodic update intervals (same assumption as in storage rollup),
+// targets which are not created again are reported for the last time with the next summary
+func restore(now time.Time) error {
+	from := prev(now)
+	events, err := storage.Events(storage.EventsQuery{From: from, To: now})
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	periodStart = from
+	last := map[workers.TargetAddr]workers.StatusEvent{}
+	for _, e := range events {
+		event := workers.StatusEvent{
+			Ts:        e.Ts,
+			Target:    e.Target,
+			Status:    e.Status,
+			UpdSource: e.UpdSource,
+			Meta:      workers.Meta{Name: e.Name, Labels: e.Labels},
+		}
+		observe_unsafe(event)
+		last[e.Target] = event
+	}
+	for _, event := range last {
+		if event.UpdSource == workers.UPD_SOURCE_WORKER_STOP {
+			continue
+		}
+		event.Ts = event.Ts.Add(2 * registry.Config.PeriodicUpdateInterval)
+		if event.Ts.After(now) {
+			event.Ts = now
+		}
+		event.Status = workers.STATUS_UNKNOWN
+		event.UpdSource = workers.UPD_SOURCE_WORKER_STOP
+		observe_unsafe(event)
+	}
+	slog.Info(tagBase.F("Restored from event log"), "from", from, "events", len(events), "targets", len(last))
+	return nil
+}
+
+// start daily publisher, returned func stops it.
+// with event log enabled current period is restored from it, otherwise
+// the first period starts now and is shorter than a day
+func Start() func() {
+	if !Enabled() {
+		slog.Info(tagBase.F("Daily summary is disabled"))
+		return func() {}
+	}
+	restored := false
+	if storage.Enabled() {
+		if err := restore(time.Now()); err != nil {
+			counters.Errors.Inc()
+			slog.Error(tagBase.F("Failed to restore from event log"), "err", err)
+		} else {
+			restored = true
+		}
+	}
+	if !restored {
+		lock.Lock()
+		periodStart = time.Now()
+		lock.Unlock()
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			when := next(time.Now())
+			slog.Debug(tagBase.F("Next summary"), "at", when)
+			timer := time.NewTimer(time.Until(when))
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+				publish(when)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,433 @@
+package syslog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/logger"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+	"github.com/fedulovivan/mhz19-go/pkg/utils"
+)
+
+// syslog sink sends status transitions (periodic updates are not sent) and application errors
+// (records of slog error level) as RFC 5424 messages to udp, tcp or unix socket collector.
+// target ip, name, status and update source are passed as structured data,
+// so collector could filter on them without parsing the message text.
+// udp and unix datagram sockets get one message per datagram, stream sockets use
+// octet counting framing of RFC 6587. messages are sent by a background goroutine,
+// every write has a deadline, connection is re-established on the next message after failure.
+
+const (
+	QUEUE_SIZE = 256
+	// sd-id of the structured data element, 32473 is the enterprise number reserved for documentation
+	SD_ID         = "pinger@32473"
+	MSG_ID        = "status"
+	MSG_ID_ERROR  = "error"
+	TIMESTAMP     = "2006-01-02T15:04:05.000000Z07:00"
+	DIAL_TIMEOUT  = 5 * time.Second
+	WRITE_TIMEOUT = 5 * time.Second
+)
+
+const (
+	SEVERITY_ERR     = 3
+	SEVERITY_WARNING = 4
+	SEVERITY_NOTICE  = 5
+	SEVERITY_INFO    = 6
+)
+
+var FACILITIES = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+var tagBase = utils.NewTag(logger.TAG_SLOG)
+
+type Options struct {
+	Facility int
+	AppName  string
+	Hostname string
+	// zero means WRITE_TIMEOUT
+	WriteTimeout time.Duration
+}
+
+type Writer struct {
+	network string
+	addr    string
+	opts    Options
+	procId  string
+	conn    net.Conn
+	queue   chan []byte
+	// guards queue against sends after Close, since errors could be logged at any time
+	lock   sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// offline and unreachable targets are warnings, invalid one (failed to start pinger) is an error
+func Severity(status workers.OnlineStatus) int {
+	switch status {
+	case workers.STATUS_ONLINE:
+		return SEVERITY_INFO
+	case workers.STATUS_OFFLINE, workers.STATUS_UNREACHABLE:
+		return SEVERITY_WARNING
+	case workers.STATUS_INVALID:
+		return SEVERITY_ERR
+	default:
+		return SEVERITY_NOTICE
+	}
+}
+
+// facility name like "daemon" or "local0", or its number
+func ParseFacility(value string) (int, error) {
+	if f, ok := FACILITIES[strings.ToLower(value)]; ok {
+		return f, nil
+	}
+	f, err := strconv.Atoi(value)
+	if err != nil || f < 0 || f > 23 {
+		return 0, fmt.Errorf("unknown syslog facility %q", value)
+	}
+	return f, nil
+}
+
+// parse collector address like udp://host:514, tcp://host:601 or unix:///dev/log
+// into network and address accepted by net.Dial
+func ParseAddr(value string) (string, string, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" || u.Port() == "" {
+			return "", "", fmt.Errorf("invalid syslog address %q, expected %s://host:port", value, u.Scheme)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("invalid syslog address %q, expected %s:///path/to/socket", value, u.Scheme)
+		}
+		return u.Scheme, u.Path, nil
+	}
+	return "", "", fmt.Errorf("invalid syslog address %q, expected udp, tcp, unix or unixgram scheme", value)
+}
+
+// header values should be printable ascii without spaces, "-" stands for empty value
+func headerValue(value string, maxLen int) string {
+	value = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, value)
+	if len(value) > maxLen {
+		value = value[:maxLen]
+	}
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+var paramEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func header(b *strings.Builder, opts Options, procId string, severity int, ts time.Time, msgId string) {
+	fmt.Fprintf(
+		b, "<%d>1 %s %s %s %s %s ",
+		opts.Facility*8+severity,
+		ts.Format(TIMESTAMP),
+		headerValue(opts.Hostname, 255),
+		headerValue(opts.AppName, 48),
+		headerValue(procId, 128),
+		msgId,
+	)
+}
+
+// format RFC 5424 message, without transport framing
+func Format(event workers.StatusEvent, opts Options, procId string) []byte {
+	var b strings.Builder
+	header(&b, opts, procId, Severity(event.Status), event.Ts, MSG_ID)
+	b.WriteString("[" + SD_ID)
+	param := func(name string, value string) {
+		b.WriteString(" " + name + `="` + paramEscaper.Replace(value) + `"`)
+	}
+	param("ip", string(event.Target))
+	if event.Name != "" {
+		param("name", event.Name)
+	}
+	param("status", event.StatusName())
+	param("source", workers.UPD_SOURCE_NAMES[event.UpdSource])
+	if event.Rtt > 0 {
+		param("rttMs", strconv.FormatFloat(float64(event.Rtt.Microseconds())/1000, 'f', -1, 64))
+	}
+	if !event.LastSeen.IsZero() {
+		param("lastSeen", event.LastSeen.Format(time.RFC3339))
+	}
+	b.WriteString("] ")
+	if event.Name != "" {
+		b.WriteString(event.Name + " (" + string(event.Target) + ")")
+	} else {
+		b.WriteString(string(event.Target))
+	}
+	b.WriteString(" is " + event.StatusName())
+	return []byte(b.String())
+}
+
+// format log record as RFC 5424 message without structured data, attributes are appended to the text
+func FormatError(r slog.Record, opts Options, procId string) []byte {
+	var b strings.Builder
+	header(&b, opts, procId, SEVERITY_ERR, r.Time, MSG_ID_ERROR)
+	b.WriteString("- " + r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		b.WriteString(" " + a.String())
+		return true
+	})
+	return []byte(b.String())
+}
+
+// create writer and start sending goroutine, collector does not have to be available yet
+func NewWriter(network string, addr string, opts Options) *Writer {
+	w := &Writer{
+		network: network,
+		addr:    addr,
+		opts:    opts,
+		procId:  strconv.Itoa(os.Getpid()),
+		queue:   make(chan []byte, QUEUE_SIZE),
+	}
+	if w.opts.WriteTimeout <= 0 {
+		w.opts.WriteTimeout = WRITE_TIMEOUT
+	}
+	w.wg.Add(1)
+	go w.sender()
+	return w
+}
+
+// never blocks, event is dropped when queue is full
+func (w *Writer) Send(event workers.StatusEvent) {
+	if event.UpdSource == workers.UPD_SOURCE_PERIODIC {
+		return
+	}
+	if !w.enqueue(Format(event, w.opts, w.procId)) {
+		slog.Warn(tagBase.F("Queue is full, event dropped"), "target", event.Target)
+	}
+}
+
+// same as Send, for log records
+func (w *Writer) SendError(r slog.Record) {
+	w.enqueue(FormatError(r, w.opts, w.procId))
+}
+
+// false when message is dropped, messages sent after Close are dropped silently
+func (w *Writer) enqueue(msg []byte) bool {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.closed {
+		return true
+	}
+	select {
+	case w.queue <- msg:
+		return true
+	default:
+		counters.SyslogDropped.Inc()
+		return false
+	}
+}
+
+// send queued messages and close connection,
+// once collector fails after Close, the rest of the queue is dropped, so shutdown is not blocked by it
+func (w *Writer) Close() {
+	w.lock.Lock()
+	w.closed = true
+	close(w.queue)
+	w.lock.Unlock()
+	w.wg.Wait()
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+}
+
+func (w *Writer) isClosed() bool {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.closed
+}
+
+func (w *Writer) sender() {
+	defer w.wg.Done()
+	for msg := range w.queue {
+		// stale stream connection is detected on write only, so message is retried once with a fresh one
+		err := w.write(msg)
+		if err != nil && w.conn != nil && !w.isClosed() {
+			_ = w.conn.Close()
+			w.conn = nil
+			err = w.write(msg)
+		}
+		if err != nil {
+			if w.conn != nil {
+				_ = w.conn.Close()
+				w.conn = nil
+			}
+			counters.Errors.Inc()
+			counters.SyslogDropped.Inc()
+			slog.Error(tagBase.F("Failed to send"), "addr", w.addr, "err", err)
+			if w.isClosed() {
+				counters.SyslogDropped.Add(float64(len(w.queue)))
+				return
+			}
+			continue
+		}
+		counters.SyslogSent.Inc()
+	}
+}
+
+func (w *Writer) write(msg []byte) error {
+	stream := w.network == "tcp" || w.network == "unix"
+	if w.conn != nil && stream && !alive(w.conn) {
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+	if w.conn == nil {
+		conn, err := w.dial()
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+	if stream {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	// stalled stream collector would otherwise block sender forever
+	if err := w.conn.SetWriteDeadline(time.Now().Add(w.opts.WriteTimeout)); err != nil {
+		return err
+	}
+	_, err := w.conn.Write(msg)
+	return err
+}
+
+// write to the stream connection closed by collector (e.g. on its restart) succeeds and the message is lost,
+// collector never sends anything, so connection which is readable (with EOF) is closed by the peer
+func alive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	_, err := conn.Read(make([]byte, 1))
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// unix address is dialed as datagram socket first, like /dev/log usually is, then as stream one
+func (w *Writer) dial() (net.Conn, error) {
+	if w.network == "unix" {
+		if conn, err := net.DialTimeout("unixgram", w.addr, DIAL_TIMEOUT); err == nil {
+			w.network = "unixgram"
+			return conn, nil
+		}
+	}
+	return net.DialTimeout(w.network, w.addr, DIAL_TIMEOUT)
+}
+
+// default writer configured with PINGER_SYSLOG_* env variables
+
+var writer *Writer
+
+func Enabled() bool {
+	return writer != nil
+}
+
+// start default writer, no-op when PINGER_SYSLOG_ADDR is empty
+func Start() {
+	conf := registry.Config
+	if conf.SyslogAddr == "" {
+		slog.Info(tagBase.F("Syslog is disabled"))
+		return
+	}
+	network, addr, err := ParseAddr(conf.SyslogAddr)
+	if err != nil {
+		panic("invalid PINGER_SYSLOG_ADDR: " + err.Error())
+	}
+	facility, err := ParseFacility(conf.SyslogFacility)
+	if err != nil {
+		panic("invalid PINGER_SYSLOG_FACILITY: " + err.Error())
+	}
+	hostname := conf.SyslogHostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	writer = NewWriter(network, addr, Options{
+		Facility: facility,
+		AppName:  conf.SyslogAppName,
+		Hostname: hostname,
+	})
+	// SetDefault redirects log package output to the new handler, while wrapped default handler
+	// of slog writes with log package, so output is restored to avoid the loop
+	out, flags := log.Writer(), log.Flags()
+	slog.SetDefault(slog.New(&errorHandler{Handler: slog.Default().Handler()}))
+	log.SetOutput(out)
+	log.SetFlags(flags)
+	slog.Info(tagBase.F("Started"), "network", network, "addr", addr, "facility", facility)
+}
+
+// wraps default slog handler and forwards error records to syslog writer,
+// except the ones of syslog writer itself, which would loop when collector is down
+type errorHandler struct {
+	slog.Handler
+	attrs []slog.Attr
+}
+
+func (h *errorHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError && writer != nil && !strings.HasPrefix(r.Message, string(logger.TAG_SLOG)) {
+		fwd := r.Clone()
+		fwd.AddAttrs(h.attrs...)
+		writer.SendError(fwd)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *errorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &errorHandler{Handler: h.Handler.WithAttrs(attrs), attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *errorHandler) WithGroup(name string) slog.Handler {
+	return &errorHandler{Handler: h.Handler.WithGroup(name), attrs: h.attrs}
+}
+
+func Stop() {
+	if writer != nil {
+		writer.Close()
+	}
+}
+
+var SendStatus workers.OnlineStatusChangeHandler = func(event workers.StatusEvent) {
+	if writer != nil {
+		writer.Send(event)
+	}
+}
@@ -0,0 +1,198 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/workers"
+)
+
+var opts = Options{Facility: 3, AppName: "device-pinger", Hostname: "host"}
+
+func event(status workers.OnlineStatus, source workers.UpdSource) workers.StatusEvent {
+	return workers.StatusEvent{
+		Ts:        time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+		Target:    "10.0.0.1",
+		Status:    status,
+		UpdSource: source,
+		Meta:      workers.Meta{Name: `ph"one]`},
+	}
+}
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		name     string
+		msg      []byte
+		expected string
+	}{
+		{
+			"status",
+			Format(event(workers.STATUS_OFFLINE, workers.UPD_SOURCE_ONLINE_CHECKER), opts, "42"),
+			`<28>1 2024-01-01T10:00:00.000000Z host device-pinger 42 status [pinger@32473 ip="10.0.0.1" name="ph\"one\]" status="offline" source="online checker"] ph"one] (10.0.0.1) is offline`,
+		},
+		{
+			"error",
+			FormatError(slog.NewRecord(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), slog.LevelError, "[mqtt   ] Failed", 0), Options{Facility: 16, AppName: "app name"}, "42"),
+			`<131>1 2024-01-01T10:00:00.000000Z - appname 42 error - [mqtt   ] Failed`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if string(c.msg) != c.expected {
+				t.Errorf("got\n%s\nexpected\n%s", c.msg, c.expected)
+			}
+		})
+	}
+}
+
+func TestUdp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w := NewWriter("udp", conn.LocalAddr().String(), opts)
+	w.Send(event(workers.STATUS_ONLINE, workers.UPD_SOURCE_PERIODIC))
+	w.Send(event(workers.STATUS_ONLINE, workers.UPD_SOURCE_PING_ON_RECV))
+	r := slog.NewRecord(time.Now(), slog.LevelError, "failed", 0)
+	r.AddAttrs(slog.String("err", "boom"))
+	w.SendError(r)
+	w.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	got := []string{}
+	for len(got) < 2 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(buf[:n]))
+	}
+	// periodic update is not sent, so the first datagram is the transition
+	if !strings.HasPrefix(got[0], "<30>1 ") || !strings.Contains(got[0], `status="online"`) {
+		t.Errorf("unexpected status message %s", got[0])
+	}
+	if !strings.HasPrefix(got[1], "<27>1 ") || !strings.HasSuffix(got[1], " error - failed err=boom") {
+		t.Errorf("unexpected error message %s", got[1])
+	}
+}
+
+// octet counting framing, MSGLEN SP MSG
+func readFrame(r *bufio.Reader) (string, error) {
+	size, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func TestTcpReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	w := NewWriter("tcp", ln.Addr().String(), opts)
+
+	w.Send(event(workers.STATUS_ONLINE, workers.UPD_SOURCE_PING_ON_RECV))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := readFrame(bufio.NewReader(conn))
+	if err != nil || !strings.Contains(msg, `status="online"`) {
+		t.Fatalf("unexpected first frame %q: %v", msg, err)
+	}
+	// collector restart, writer should reconnect on the next message
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	w.Send(event(workers.STATUS_OFFLINE, workers.UPD_SOURCE_ONLINE_CHECKER))
+	conn, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err = readFrame(bufio.NewReader(conn))
+	if err != nil || !strings.Contains(msg, `status="offline"`) {
+		t.Fatalf("unexpected frame after reconnect %q: %v", msg, err)
+	}
+	w.Close()
+}
+
+func TestCloseWithStalledCollector(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// collector accepts connection, but never reads
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			<-done
+		}
+	}()
+	w := NewWriter("tcp", ln.Addr().String(), Options{WriteTimeout: 100 * time.Millisecond})
+	// message larger than socket buffers blocks the write
+	e := event(workers.STATUS_ONLINE, workers.UPD_SOURCE_PING_ON_RECV)
+	e.Name = strings.Repeat("x", 16<<20)
+	for i := 0; i < 3; i++ {
+		w.Send(e)
+	}
+	start := time.Now()
+	w.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("close took %s", elapsed)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writer = NewWriter("udp", conn.LocalAddr().String(), opts)
+	defer func() { writer = nil }()
+	h := &errorHandler{Handler: slog.NewTextHandler(io.Discard, nil)}
+	logger := slog.New(h).With("target", "10.0.0.1")
+	logger.Info("not forwarded")
+	logger.Error("[syslog ] Failed to send")
+	logger.Error("failed", "err", "boom")
+	_ = h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelWarn, "warning", 0))
+	writer.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !strings.HasSuffix(msg, " error - failed err=boom target=10.0.0.1") {
+		t.Errorf("unexpected message %s", msg)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := conn.ReadFrom(buf); err == nil {
+		t.Errorf("unexpected message %s", buf[:n])
+	}
+}
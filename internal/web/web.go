@@ -0,0 +1,19 @@
+package web
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// single page status dashboard, served from the binary,
+// uses rest api for actions and server-sent events for live updates
+
+//go:embed index.html
+var indexHtml []byte
+
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(indexHtml)
+	})
+}
@@ -0,0 +1,320 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/logger"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/schema"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+	"github.com/fedulovivan/mhz19-go/pkg/utils"
+)
+
+// webhook sink POSTs json status event to the configured urls on every status transition
+// (periodic updates are not sent). every url has its own queue and delivery goroutine,
+// so slow or failing receiver does not delay the others, events of one url are delivered in order.
+// failed deliveries are retried with exponential backoff, events which were not delivered
+// after all attempts or did not fit into the queue are counted as dead letters.
+// on shutdown queued events are delivered within drain timeout, without retries,
+// then in-flight requests are aborted and the rest of the queue is counted as dead letters.
+
+const (
+	QUEUE_SIZE       = 256
+	MAX_BACKOFF      = time.Minute
+	MAX_DRAIN        = 64 * 1024
+	HEADER_SIGNATURE = "X-Pinger-Signature"
+	HEADER_EVENT     = "X-Pinger-Event"
+)
+
+var tagBase = utils.NewTag(logger.TAG_HOOK)
+
+// configuration of single webhook, filters follow the same rules as /events stream:
+// event should match any of the targets and names, and all of the labels, empty filter matches everything
+type Hook struct {
+	Url     string               `json:"url" jsonschema:"required"`
+	Targets []workers.TargetAddr `json:"targets"`
+	Names   []string             `json:"names"`
+	Labels  map[string]string    `json:"labels"`
+	Headers map[string]string    `json:"headers"`
+	// overrides PINGER_WEBHOOK_SECRET for this url, "-" disables signing
+	Secret string `json:"secret"`
+}
+
+type Options struct {
+	Secret  string
+	Timeout time.Duration
+	Retries int
+	Backoff time.Duration
+	// how long Close waits for queued events, zero means Timeout
+	DrainTimeout time.Duration
+}
+
+type hook struct {
+	Hook
+	id     string // url without query and credentials, used in logs and metric labels
+	secret string
+	queue  chan []byte
+}
+
+type Sink struct {
+	hooks   []*hook
+	opts    Options
+	client  *http.Client
+	closing chan struct{}   // closed by Close, aborts pending retries
+	ctx     context.Context // cancelled after drain timeout, aborts in-flight requests
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func (h *hook) match(e workers.StatusEvent) bool {
+	if len(h.Targets) > 0 && !contains(h.Targets, e.Target) {
+		return false
+	}
+	if len(h.Names) > 0 && !contains(h.Names, e.Name) {
+		return false
+	}
+	for k, v := range h.Labels {
+		if e.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func contains[T comparable](list []T, v T) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// hex encoded hmac-sha256 of the request body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// create sink and start delivery goroutines, nil client means http.DefaultClient
+func NewSink(hooks []Hook, opts Options, client *http.Client) (*Sink, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = opts.Timeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Sink{opts: opts, client: client, closing: make(chan struct{}), ctx: ctx, cancel: cancel}
+	for _, conf := range hooks {
+		u, err := url.Parse(conf.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			cancel()
+			return nil, fmt.Errorf("invalid webhook url %q, expected http or https url", conf.Url)
+		}
+		h := &hook{
+			Hook:   conf,
+			id:     u.Scheme + "://" + u.Host + u.Path,
+			secret: opts.Secret,
+			queue:  make(chan []byte, QUEUE_SIZE),
+		}
+		if conf.Secret != "" {
+			h.secret = conf.Secret
+		}
+		if h.secret == "-" {
+			h.secret = ""
+		}
+		s.hooks = append(s.hooks, h)
+	}
+	s.wg.Add(len(s.hooks))
+	for _, h := range s.hooks {
+		go s.deliver(h)
+	}
+	return s, nil
+}
+
+// never blocks, event is dropped to dead letters when queue of the hook is full
+func (s *Sink) Send(event workers.StatusEvent) {
+	if event.UpdSource == workers.UPD_SOURCE_PERIODIC {
+		return
+	}
+	var body []byte
+	for _, h := range s.hooks {
+		if !h.match(event) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(event); err != nil {
+				counters.Errors.Inc()
+				slog.Error(tagBase.F("Failed to encode event"), "err", err)
+				return
+			}
+		}
+		select {
+		case h.queue <- body:
+		default:
+			counters.WebhookDeadLetters.WithLabelValues(h.id).Inc()
+			slog.Warn(tagBase.F("Queue is full, event dropped"), "url", h.id, "target", event.Target)
+		}
+	}
+}
+
+// stop accepting events and wait for the queued ones at most drain timeout, pending retries are aborted
+func (s *Sink) Close() {
+	close(s.closing)
+	for _, h := range s.hooks {
+		close(h.queue)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(s.opts.DrainTimeout):
+		slog.Warn(tagBase.F("Drain timeout, undelivered events are dropped"), "timeout", s.opts.DrainTimeout)
+		s.cancel()
+		<-done
+	}
+	s.cancel()
+}
+
+func (s *Sink) deliver(h *hook) {
+	defer s.wg.Done()
+	for body := range h.queue {
+		if s.post_with_retries(h, body) {
+			counters.WebhookDelivered.WithLabelValues(h.id).Inc()
+		} else {
+			counters.WebhookDeadLetters.WithLabelValues(h.id).Inc()
+		}
+	}
+}
+
+// first attempt is made even after Close, so events sent by stopping workers are not lost,
+// unless drain timeout is already over
+func (s *Sink) post_with_retries(h *hook, body []byte) bool {
+	backoff := s.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		if s.ctx.Err() != nil {
+			return false
+		}
+		err := s.post(h, body)
+		if err == nil {
+			return true
+		}
+		counters.Errors.Inc()
+		slog.Error(tagBase.F("Delivery failed"), "url", h.id, "attempt", attempt+1, "err", err)
+		if attempt >= s.opts.Retries {
+			return false
+		}
+		select {
+		case <-s.closing:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, MAX_BACKOFF)
+	}
+}
+
+func (s *Sink) post(h *hook, body []byte) error {
+	ctx, cancel := context.WithTimeout(s.ctx, s.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HEADER_EVENT, "status")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	if h.secret != "" {
+		req.Header.Set(HEADER_SIGNATURE, "sha256="+Sign(h.secret, body))
+	}
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	// response is not used, but unread body prevents reuse of keep-alive connection,
+	// larger bodies are not worth reading, connection is just closed then
+	_, _ = io.Copy(io.Discard, io.LimitReader(rsp.Body, MAX_DRAIN))
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", rsp.Status)
+	}
+	return nil
+}
+
+// default sink configured with PINGER_WEBHOOKS and other PINGER_WEBHOOK_* env variables
+
+var sink *Sink
+
+// parse and validate PINGER_WEBHOOKS json, which is array of Hook objects
+func ParseHooks(text string) ([]Hook, error) {
+	hooks := []Hook{}
+	if text == "" {
+		return hooks, nil
+	}
+	if err := schema.Validate(schema.For(hooks), []byte(text)); err != nil {
+		return nil, err
+	}
+	err := json.Unmarshal([]byte(text), &hooks)
+	return hooks, err
+}
+
+func Enabled() bool {
+	return sink != nil
+}
+
+// start default sink, no-op when PINGER_WEBHOOKS is empty
+func Start() {
+	conf := registry.Config
+	hooks, err := ParseHooks(conf.Webhooks)
+	if err != nil {
+		panic("invalid PINGER_WEBHOOKS: " + err.Error())
+	}
+	if len(hooks) == 0 {
+		slog.Info(tagBase.F("Webhooks are disabled"))
+		return
+	}
+	sink, err = NewSink(hooks, Options{
+		Secret:  conf.WebhookSecret,
+		Timeout: conf.WebhookTimeout,
+		Retries: conf.WebhookRetries,
+		Backoff: conf.WebhookBackoff,
+	}, nil)
+	if err != nil {
+		panic("invalid PINGER_WEBHOOKS: " + err.Error())
+	}
+	for _, h := range sink.hooks {
+		slog.Info(tagBase.F("Webhook configured"), "url", h.id, "signed", h.secret != "")
+	}
+}
+
+func Stop() {
+	if sink != nil {
+		sink.Close()
+	}
+}
+
+var SendStatus workers.OnlineStatusChangeHandler = func(event workers.StatusEvent) {
+	if sink != nil {
+		sink.Send(event)
+	}
+}
@@ -0,0 +1,250 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/workers"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type request struct {
+	path      string
+	signature string
+	header    string
+	body      []byte
+	at        time.Time
+}
+
+// test receiver, which records requests and responds with the statuses from the list,
+// the last status is repeated when list is over
+type receiver struct {
+	sync.Mutex
+	*httptest.Server
+	statuses []int
+	requests []request
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.Lock()
+		defer r.Unlock()
+		r.requests = append(r.requests, request{
+			path:      req.URL.Path,
+			signature: req.Header.Get(HEADER_SIGNATURE),
+			header:    req.Header.Get("X-Custom"),
+			body:      body,
+			at:        time.Now(),
+		})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status = r.statuses[0]
+			if len(r.statuses) > 1 {
+				r.statuses = r.statuses[1:]
+			}
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []request {
+	r.Lock()
+	defer r.Unlock()
+	return append([]request{}, r.requests...)
+}
+
+func deadLetters(id string) float64 {
+	m := &dto.Metric{}
+	_ = counters.WebhookDeadLetters.WithLabelValues(id).Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func delivered(id string) float64 {
+	m := &dto.Metric{}
+	_ = counters.WebhookDelivered.WithLabelValues(id).Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func event(target string, name string, labels map[string]string) workers.StatusEvent {
+	return workers.StatusEvent{
+		Ts:        time.Now(),
+		Target:    workers.TargetAddr(target),
+		Status:    workers.STATUS_ONLINE,
+		UpdSource: workers.UPD_SOURCE_PING_ON_RECV,
+		Meta:      workers.Meta{Name: name, Labels: labels},
+	}
+}
+
+func TestSignAndFilters(t *testing.T) {
+	rcv := newReceiver(t)
+	sink, err := NewSink([]Hook{
+		{Url: rcv.URL + "/all", Headers: map[string]string{"X-Custom": "yes"}},
+		{Url: rcv.URL + "/targets", Targets: []workers.TargetAddr{"10.0.0.1"}, Secret: "other"},
+		{Url: rcv.URL + "/labels", Labels: map[string]string{"owner": "ivan"}, Secret: "-"},
+		{Url: rcv.URL + "/names", Names: []string{"phone"}},
+	}, Options{Secret: "secret", Timeout: time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Send(event("10.0.0.1", "phone", nil))
+	sink.Send(event("10.0.0.2", "laptop", map[string]string{"owner": "ivan"}))
+	periodic := event("10.0.0.1", "phone", nil)
+	periodic.UpdSource = workers.UPD_SOURCE_PERIODIC
+	sink.Send(periodic)
+	sink.Close()
+
+	got := map[string][]string{}
+	for _, r := range rcv.received() {
+		var e struct {
+			Target string `json:"target"`
+		}
+		if err := json.Unmarshal(r.body, &e); err != nil {
+			t.Fatal(err)
+		}
+		got[r.path] = append(got[r.path], e.Target)
+		secret := map[string]string{"/all": "secret", "/targets": "other", "/names": "secret"}[r.path]
+		expected := ""
+		if secret != "" {
+			expected = "sha256=" + Sign(secret, r.body)
+		}
+		if r.signature != expected {
+			t.Errorf("%s: signature %q, expected %q", r.path, r.signature, expected)
+		}
+		if r.path == "/all" && r.header != "yes" {
+			t.Errorf("custom header is not sent")
+		}
+	}
+	expected := map[string][]string{
+		"/all":     {"10.0.0.1", "10.0.0.2"},
+		"/targets": {"10.0.0.1"},
+		"/labels":  {"10.0.0.2"},
+		"/names":   {"10.0.0.1"},
+	}
+	for path, targets := range expected {
+		if !reflect.DeepEqual(got[path], targets) {
+			t.Errorf("%s: received %v, expected %v", path, got[path], targets)
+		}
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	rcv := newReceiver(t, 500, 502, 200)
+	sink, err := NewSink([]Hook{{Url: rcv.URL + "/retry"}}, Options{Timeout: time.Second, Retries: 3, Backoff: 20 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := sink.hooks[0].id
+	before := delivered(id)
+	sink.Send(event("10.0.0.1", "", nil))
+	// wait for delivery before Close, since Close aborts retries
+	deadline := time.Now().Add(2 * time.Second)
+	for delivered(id) == before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	sink.Close()
+	reqs := rcv.received()
+	if len(reqs) != 3 {
+		t.Fatalf("received %d attempts, expected 3", len(reqs))
+	}
+	if delivered(id) != before+1 {
+		t.Errorf("delivered counter is not incremented")
+	}
+	// backoff doubles: 20ms before the second attempt, 40ms before the third one
+	if gap := reqs[1].at.Sub(reqs[0].at); gap < 20*time.Millisecond {
+		t.Errorf("second attempt after %s, expected at least 20ms", gap)
+	}
+	if gap := reqs[2].at.Sub(reqs[1].at); gap < 40*time.Millisecond {
+		t.Errorf("third attempt after %s, expected at least 40ms", gap)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	rcv := newReceiver(t, 500)
+	sink, err := NewSink([]Hook{{Url: rcv.URL + "/dead"}}, Options{Timeout: time.Second, Retries: 1, Backoff: time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := sink.hooks[0].id
+	before := deadLetters(id)
+	sink.Send(event("10.0.0.1", "", nil))
+	deadline := time.Now().Add(2 * time.Second)
+	for deadLetters(id) == before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	sink.Close()
+	if n := len(rcv.received()); n != 2 {
+		t.Errorf("received %d attempts, expected 2", n)
+	}
+	if deadLetters(id) != before+1 {
+		t.Errorf("dead letters counter is not incremented")
+	}
+}
+
+func TestCloseIsBoundedWithStalledReceiver(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	sink, err := NewSink([]Hook{{Url: srv.URL + "/stalled"}}, Options{Timeout: time.Minute, DrainTimeout: 100 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := sink.hooks[0].id
+	before := deadLetters(id)
+	for i := 0; i < 10; i++ {
+		sink.Send(event("10.0.0.1", "", nil))
+	}
+	start := time.Now()
+	sink.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("close took %s", elapsed)
+	}
+	if n := deadLetters(id) - before; n != 10 {
+		t.Errorf("%v dead letters, expected 10", n)
+	}
+}
+
+func TestConnectionIsReused(t *testing.T) {
+	var newConns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// body larger than client read buffer, so it is not consumed along with headers
+		_, _ = w.Write(bytes.Repeat([]byte(" "), 32*1024))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newConns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	sink, err := NewSink([]Hook{{Url: srv.URL}}, Options{Timeout: time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		sink.Send(event("10.0.0.1", "phone", nil))
+	}
+	sink.Close()
+	if n := newConns.Load(); n != 1 {
+		t.Errorf("%d connections were opened, expected 1", n)
+	}
+}
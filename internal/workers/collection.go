@@ -2,24 +2,62 @@ package workers
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/bus"
+	"github.com/fedulovivan/device-pinger/internal/state"
+)
+
+var (
+	ErrNotExist        = errors.New("not exist")
+	ErrAlreadyExist    = errors.New("already exist")
+	ErrAlreadyPaused   = errors.New("already paused")
+	ErrNotPaused       = errors.New("not paused")
+	ErrInvalidSchedule = errors.New("invalid schedule")
+	ErrInvalidParent   = errors.New("invalid parent")
 )
 
 type Collection struct {
 	sync.RWMutex
 	wg        sync.WaitGroup
 	data      map[TargetAddr](*Worker)
+	index     sync.Map // lock-free mirror of data, used by workers to find their parents
 	lenChange chan int
+	events    *bus.Bus[StatusEvent]
+	pings     *bus.Bus[PingSample]
 }
 
+// all workers created by collection publish status events and ping samples to the same buses
 func NewCollection() *Collection {
 	return &Collection{
 		data:      make(map[TargetAddr]*Worker),
 		lenChange: make(chan int),
+		events:    bus.New[StatusEvent](),
+		pings:     bus.New[PingSample](),
 	}
 }
 
+// register consumer of status events of all workers with its own buffer,
+// should be called before workers are created, so no events are missed
+func (c *Collection) Subscribe(name string, buffer int, handler OnlineStatusChangeHandler) {
+	c.events.Subscribe(name, buffer, handler)
+}
+
+// register consumer of ping samples of all workers, same rules as for Subscribe apply
+func (c *Collection) SubscribePings(name string, buffer int, handler PingHandler) {
+	c.pings.Subscribe(name, buffer, handler)
+}
+
+// wait until subscribers handle buffered events, should be called after workers are stopped
+func (c *Collection) CloseEvents() {
+	c.events.Close()
+	c.pings.Close()
+}
+
 func (c *Collection) Get(target TargetAddr) (*Worker, error) {
 	c.RLock()
 	defer c.RUnlock()
@@ -29,11 +67,44 @@ func (c *Collection) Get(target TargetAddr) (*Worker, error) {
 func (c *Collection) get_unsafe(target TargetAddr) (*Worker, error) {
 	w, ok := c.data[target]
 	if !ok {
-		return nil, errors.New("not exist")
+		return nil, ErrNotExist
 	}
 	return w, nil
 }
 
+// snapshot of all workers, sorted by target
+func (c *Collection) List() []*Worker {
+	c.RLock()
+	defer c.RUnlock()
+	res := make([]*Worker, 0, len(c.data))
+	for _, w := range c.data {
+		res = append(res, w)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].target < res[j].target
+	})
+	return res
+}
+
+// targets of the workers, which online checker has not ticked for longer than maxAge
+func (c *Collection) Stalled(maxAge time.Duration) []TargetAddr {
+	res := []TargetAddr{}
+	for _, w := range c.List() {
+		if time.Since(w.LastTick()) > maxAge {
+			res = append(res, w.target)
+		}
+	}
+	return res
+}
+
+func (c *Collection) lookup(target TargetAddr) *Worker {
+	w, ok := c.index.Load(target)
+	if !ok {
+		return nil
+	}
+	return w.(*Worker)
+}
+
 func (c *Collection) OnLenChange() chan int {
 	return c.lenChange
 }
@@ -44,21 +115,97 @@ func (c *Collection) StopAll() {
 	}
 }
 
-func (c *Collection) Create(
-	target TargetAddr,
-	onStatusChange OnlineStatusChangeHandler,
-) (*Worker, error) {
+func (c *Collection) Create(target TargetAddr, meta Meta) (*Worker, error) {
 	c.Lock()
 	defer c.Unlock()
 	_, ok := c.data[target]
 	if ok {
-		return nil, errors.New("already exist")
+		return nil, ErrAlreadyExist
+	}
+	if err := c.check_parent_unsafe(target, meta.Parent); err != nil {
+		return nil, err
+	}
+	worker, err := c.spawn_unsafe(target, meta, nil)
+	if err != nil {
+		return nil, err
 	}
-	c.wg.Add(1)
-	worker, _ := New(target, onStatusChange)
-	c.data[worker.target] = worker
 	slog.Debug(tagBase.F("Worker added"), "len", len(c.data))
 	c.lenChange <- len(c.data)
+	return worker, nil
+}
+
+// same as Worker.SetMeta, but current meta is merged with given update and parent is validated
+// against other workers, all under exclusive lock, so concurrent changes are neither lost nor make a cycle
+func (c *Collection) UpdateMeta(target TargetAddr, update func(meta *Meta)) (*Worker, error) {
+	c.Lock()
+	defer c.Unlock()
+	worker, err := c.get_unsafe(target)
+	if err != nil {
+		return nil, err
+	}
+	meta := worker.Meta()
+	update(&meta)
+	if err := c.check_parent_unsafe(target, meta.Parent); err != nil {
+		return nil, err
+	}
+	return worker, worker.SetMeta(meta)
+}
+
+// parent should be an existing target and should not depend on the target itself, directly or via other parents,
+// since targets in the cycle would keep each other unreachable for good
+func (c *Collection) check_parent_unsafe(target TargetAddr, parent TargetAddr) error {
+	if parent == "" {
+		return nil
+	}
+	if parent == target {
+		return fmt.Errorf("%w: target cannot depend on itself", ErrInvalidParent)
+	}
+	if _, ok := c.data[parent]; !ok {
+		return fmt.Errorf("%w: parent %s does not exist", ErrInvalidParent, parent)
+	}
+	// meta of other workers is read from lock-free copy, since collection lock is held
+	for p, steps := parent, 0; p != "" && steps <= len(c.data); steps++ {
+		if p == target {
+			return fmt.Errorf("%w: %s depends on %s, which makes a cycle", ErrInvalidParent, parent, target)
+		}
+		w, ok := c.data[p]
+		if !ok {
+			break
+		}
+		p = w.sharedMeta.Load().Parent
+	}
+	return nil
+}
+
+// order targets so that parents come before their children, which is required by Create,
+// targets which make a cycle or have unknown parent are left in place and rejected by Create
+func SortByParent(targets []TargetAddr, parent func(TargetAddr) TargetAddr) []TargetAddr {
+	known := map[TargetAddr]bool{}
+	for _, t := range targets {
+		known[t] = true
+	}
+	depth := func(t TargetAddr) int {
+		d := 0
+		for p := parent(t); known[p] && d < len(targets); p = parent(p) {
+			d++
+		}
+		return d
+	}
+	res := append([]TargetAddr{}, targets...)
+	sort.SliceStable(res, func(i, j int) bool {
+		return depth(res[i]) < depth(res[j])
+	})
+	return res
+}
+
+func (c *Collection) spawn_unsafe(target TargetAddr, meta Meta, prev *Worker) (*Worker, error) {
+	worker, err := New(target, meta, state.IsPaused(string(target)), c.lookup, c.events.Publish, c.pings.Publish, prev)
+	if err != nil {
+		return nil, err
+	}
+	c.wg.Add(1)
+	c.data[worker.target] = worker
+	c.index.Store(worker.target, worker)
 	go func() {
 		<-worker.Done()
 		c.wg.Done()
@@ -66,18 +213,70 @@ func (c *Collection) Create(
 	return worker, nil
 }
 
-func (c *Collection) Delete(target TargetAddr, onChange OnlineStatusChangeHandler) error {
+// replace worker with a fresh one, keeping its metadata and history of transitions,
+// old worker is abandoned without acquiring its mutex, since it could be wedged,
+// so metadata is taken from the lock-free copy and history ring has a lock of its own
+func (c *Collection) Rebuild(target TargetAddr) (*Worker, error) {
 	c.Lock()
 	defer c.Unlock()
-	worker, err := c.get_unsafe(target)
+	old, err := c.get_unsafe(target)
+	if err != nil {
+		return nil, err
+	}
+	old.abandon()
+	return c.spawn_unsafe(target, *old.sharedMeta.Load(), old)
+}
+
+// worker is removed under the lock, but stopped after releasing it, since Stop acquires worker mutex
+// and worker stuck in pinger call would otherwise block the whole collection, including watchdog Rebuild
+func (c *Collection) Delete(target TargetAddr) error {
+	worker, err := c.remove(target)
 	if err != nil {
 		return err
 	}
 	worker.Stop()
+	return nil
+}
+
+func (c *Collection) remove(target TargetAddr) (*Worker, error) {
+	c.Lock()
+	defer c.Unlock()
+	worker, err := c.get_unsafe(target)
+	if err != nil {
+		return nil, err
+	}
 	delete(c.data, target)
+	c.index.Delete(target)
+	deleteReportGauges(target)
+	state.SetPaused(string(target), false)
 	slog.Debug(tagBase.F("Worker deleted"), "len", len(c.data))
 	c.lenChange <- len(c.data)
-	return nil
+	return worker, nil
+}
+
+// paused state is persisted, so worker is re-created paused after restart
+func (c *Collection) Pause(target TargetAddr) (*Worker, error) {
+	worker, err := c.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := worker.Pause(); err != nil {
+		return nil, err
+	}
+	state.SetPaused(string(target), true)
+	return worker, nil
+}
+
+func (c *Collection) Resume(target TargetAddr) (*Worker, error) {
+	worker, err := c.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := worker.Resume(); err != nil {
+		return nil, err
+	}
+	state.SetPaused(string(target), false)
+	return worker, nil
 }
 
 func (c *Collection) Wait() {
@@ -0,0 +1,39 @@
+package workers
+
+import "github.com/fedulovivan/device-pinger/internal/registry"
+
+// parent/child relationship between targets, e.g. phones behind the access point,
+// when parent is down, children get STATUS_UNREACHABLE instead of STATUS_OFFLINE.
+// parent state is read only via atomics, since worker could not acquire collection
+// or other worker mutex while holding its own, which would end up with deadlock on Delete
+
+// resolves target into worker without locking, returns nil for unknown target
+type WorkerLookup func(target TargetAddr) *Worker
+
+func (worker *Worker) parent_unsafe() *Worker {
+	if worker.meta.Parent == "" || worker.lookup == nil {
+		return nil
+	}
+	return worker.lookup(worker.meta.Parent)
+}
+
+// status for the target, which has not replied for PINGER_OFFLINE_AFTER, taking its parent into account,
+// hold means current status should be kept for now, since parent has gone silent at the same time
+// and it is not yet known whether it is down
+func (worker *Worker) offline_status_unsafe() (status OnlineStatus, hold bool) {
+	parent := worker.parent_unsafe()
+	// parent, which is not monitored now or which status is frozen by schedule, cannot tell anything
+	if parent == nil || !parent.probing() || parent.suppressed() {
+		return STATUS_OFFLINE, false
+	}
+	switch parent.Status() {
+	case STATUS_OFFLINE, STATUS_UNREACHABLE:
+		return STATUS_UNREACHABLE, false
+	case STATUS_ONLINE:
+		// alive parent keeps replying every PINGER_PINGER_INTERVAL, while child is silent
+		if !parent.LastRecv().After(worker.lastSeen.Add(registry.Config.PingerInterval)) {
+			return worker.status, true
+		}
+	}
+	return STATUS_OFFLINE, false
+}
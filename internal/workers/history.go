@@ -0,0 +1,98 @@
+package workers
+
+import (
+	"sync"
+	"time"
+)
+
+// in-memory history of status transitions of the worker, bounded by PINGER_HISTORY_SIZE,
+// oldest entries are overwritten when buffer is full
+
+type Transition struct {
+	Ts        time.Time    `json:"ts"`
+	From      OnlineStatus `json:"from"`
+	To        OnlineStatus `json:"to"`
+	UpdSource UpdSource    `json:"updSource"`
+	RttMs     float64      `json:"rttMs"`
+}
+
+// time range and limit for the history query, zero values mean no restriction,
+// limit keeps the most recent entries
+type HistoryQuery struct {
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+// ring has its own lock, so watchdog could copy it from the wedged worker
+type ring struct {
+	sync.Mutex
+	items []Transition
+	next  int
+	full  bool
+}
+
+func newRing(size int) *ring {
+	return &ring{items: make([]Transition, size)}
+}
+
+func (r *ring) push(t Transition) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.items) == 0 {
+		return
+	}
+	r.items[r.next] = t
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// entries from oldest to newest
+func (r *ring) all() []Transition {
+	items, _ := r.snapshot()
+	return items
+}
+
+// entries from oldest to newest and whether older entries were overwritten
+func (r *ring) snapshot() ([]Transition, bool) {
+	r.Lock()
+	defer r.Unlock()
+	if !r.full {
+		return append([]Transition{}, r.items[:r.next]...), false
+	}
+	return append(append([]Transition{}, r.items[r.next:]...), r.items[:r.next]...), true
+}
+
+// copy with the same capacity
+func (r *ring) clone() *ring {
+	r.Lock()
+	defer r.Unlock()
+	return &ring{items: append([]Transition{}, r.items...), next: r.next, full: r.full}
+}
+
+func (q HistoryQuery) match(t Transition) bool {
+	if !q.From.IsZero() && t.Ts.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && t.Ts.After(q.To) {
+		return false
+	}
+	return true
+}
+
+func (worker *Worker) History(q HistoryQuery) []Transition {
+	worker.Lock()
+	defer worker.Unlock()
+	res := []Transition{}
+	for _, t := range worker.history.all() {
+		if q.match(t) {
+			res = append(res, t)
+		}
+	}
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[len(res)-q.Limit:]
+	}
+	return res
+}
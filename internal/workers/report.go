@@ -0,0 +1,212 @@
+package workers
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// availability report over rolling windows, computed from the in-memory history of transitions,
+// which covers at most the lifetime of the worker and the last PINGER_HISTORY_SIZE transitions,
+// older part of the windows is taken from the durable period source (event log), when it is set.
+// only ONLINE and OFFLINE periods are counted, time spent in other statuses
+// (unknown, paused, off-schedule, unreachable) does not affect availability.
+// outage is a continuous OFFLINE period.
+
+var REPORT_WINDOWS = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+type WindowReport struct {
+	Window string `json:"window"`
+	// start of the data within the window, later than window start, when history is shorter
+	Since time.Time `json:"since"`
+	// set when data does not cover the whole window
+	Partial          bool    `json:"partial"`
+	MonitoredSeconds float64 `json:"monitoredSeconds"`
+	OnlineSeconds    float64 `json:"onlineSeconds"`
+	// percent of online time out of monitored time, null when nothing was monitored
+	Availability  *float64 `json:"availability"`
+	Outages       int      `json:"outages"`
+	OutageSeconds float64  `json:"outageSeconds"`
+	// mean time between failures and to recovery, null when there were no outages
+	MtbfSeconds *float64 `json:"mtbfSeconds"`
+	MttrSeconds *float64 `json:"mttrSeconds"`
+}
+
+type Report struct {
+	Target  TargetAddr     `json:"target"`
+	Ts      time.Time      `json:"ts"`
+	Windows []WindowReport `json:"windows"`
+}
+
+// period of time in single status
+type Period struct {
+	From   time.Time
+	To     time.Time
+	Status OnlineStatus
+}
+
+// durable source of status periods of the target, which survives restarts (like sqlite event log),
+// periods should be ordered and should not overlap
+type PeriodSource func(target TargetAddr, from time.Time, to time.Time) ([]Period, error)
+
+var periodSource PeriodSource
+
+// should be set before workers are created
+func SetPeriodSource(source PeriodSource) {
+	periodSource = source
+}
+
+// period source is queried without holding the worker lock
+func (worker *Worker) Report() Report {
+	now := time.Now()
+	worker.Lock()
+	periods := worker.periods_unsafe(now)
+	worker.Unlock()
+	if periodSource != nil {
+		// in-memory history is more precise and up to date, so stored periods are used only before it
+		until := now
+		if len(periods) > 0 {
+			until = periods[0].From
+		}
+		longest := REPORT_WINDOWS[len(REPORT_WINDOWS)-1].Duration
+		stored, err := periodSource(worker.target, now.Add(-longest), until)
+		if err != nil {
+			counters.Errors.Inc()
+			slog.Error(worker.tag.F("Failed to read stored periods"), "err", err)
+		}
+		for i := range stored {
+			if stored[i].To.After(until) {
+				stored[i].To = until
+			}
+		}
+		periods = append(stored, periods...)
+	}
+	res := Report{Target: worker.target, Ts: now, Windows: []WindowReport{}}
+	for _, w := range REPORT_WINDOWS {
+		res.Windows = append(res.Windows, windowReport(w.Name, periods, now.Add(-w.Duration), now))
+	}
+	return res
+}
+
+// history converted to continuous periods, ending now
+func (worker *Worker) periods_unsafe(now time.Time) []Period {
+	transitions, full := worker.history.snapshot()
+	res := []Period{}
+	// when ring is full, status before the oldest transition is unknown
+	if !full {
+		status := worker.status
+		if len(transitions) > 0 {
+			status = transitions[0].From
+		}
+		res = append(res, Period{From: worker.createdAt, Status: status})
+	}
+	for _, t := range transitions {
+		if len(res) > 0 {
+			res[len(res)-1].To = t.Ts
+		}
+		res = append(res, Period{From: t.Ts, Status: t.To})
+	}
+	if len(res) > 0 {
+		res[len(res)-1].To = now
+	}
+	return res
+}
+
+// adjacent periods in the same status are joined, since stored periods have one period per event
+// (including periodic updates) and stored and in-memory ones could meet in the middle of an outage,
+// periods separated by a gap (application was not running) are kept apart
+func mergePeriods(periods []Period) []Period {
+	res := make([]Period, 0, len(periods))
+	for _, p := range periods {
+		if n := len(res); n > 0 && res[n-1].Status == p.Status && !p.From.After(res[n-1].To) {
+			if p.To.After(res[n-1].To) {
+				res[n-1].To = p.To
+			}
+			continue
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+func windowReport(name string, periods []Period, from time.Time, to time.Time) WindowReport {
+	res := WindowReport{Window: name, Since: to}
+	periods = mergePeriods(periods)
+	for _, s := range periods {
+		start, end := s.From, s.To
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			continue
+		}
+		if start.Before(res.Since) {
+			res.Since = start
+		}
+		seconds := end.Sub(start).Seconds()
+		switch s.Status {
+		case STATUS_ONLINE:
+			res.OnlineSeconds += seconds
+			res.MonitoredSeconds += seconds
+		case STATUS_OFFLINE:
+			res.Outages++
+			res.OutageSeconds += seconds
+			res.MonitoredSeconds += seconds
+		}
+	}
+	res.Partial = res.Since.After(from)
+	if res.MonitoredSeconds > 0 {
+		availability := 100 * res.OnlineSeconds / res.MonitoredSeconds
+		res.Availability = &availability
+	}
+	if res.Outages > 0 {
+		mtbf := res.OnlineSeconds / float64(res.Outages)
+		mttr := res.OutageSeconds / float64(res.Outages)
+		res.MtbfSeconds = &mtbf
+		res.MttrSeconds = &mttr
+	}
+	return res
+}
+
+// refresh prometheus gauges of the worker, gauges of absent values are removed,
+// so window without data is not reported as 0% available
+func (worker *Worker) export_report() {
+	target := string(worker.target)
+	for _, w := range worker.Report().Windows {
+		set := func(gauge *prometheus.GaugeVec, v *float64) {
+			if v == nil {
+				gauge.DeleteLabelValues(target, w.Window)
+			} else {
+				gauge.WithLabelValues(target, w.Window).Set(*v)
+			}
+		}
+		set(counters.Availability, w.Availability)
+		set(counters.Mtbf, w.MtbfSeconds)
+		set(counters.Mttr, w.MttrSeconds)
+		counters.Outages.WithLabelValues(target, w.Window).Set(float64(w.Outages))
+		counters.OutageSeconds.WithLabelValues(target, w.Window).Set(w.OutageSeconds)
+	}
+}
+
+// gauges of deleted target should not be scraped anymore
+func deleteReportGauges(target TargetAddr) {
+	labels := prometheus.Labels{"target": string(target)}
+	counters.Availability.DeletePartialMatch(labels)
+	counters.Outages.DeletePartialMatch(labels)
+	counters.OutageSeconds.DeletePartialMatch(labels)
+	counters.Mtbf.DeletePartialMatch(labels)
+	counters.Mttr.DeletePartialMatch(labels)
+}
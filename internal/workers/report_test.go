@@ -0,0 +1,69 @@
+package workers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowReportMergesPeriods(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	cases := []struct {
+		name    string
+		periods []Period
+		outages int
+		mttr    float64
+	}{
+		{
+			"two offline rows in a row are one outage",
+			[]Period{
+				{at(0), at(10), STATUS_ONLINE},
+				{at(10), at(20), STATUS_OFFLINE},
+				{at(20), at(30), STATUS_OFFLINE},
+				{at(30), at(60), STATUS_ONLINE},
+			},
+			1, 1200,
+		},
+		{
+			"outage across stored and in-memory periods",
+			[]Period{
+				{at(0), at(10), STATUS_ONLINE},
+				{at(10), at(20), STATUS_OFFLINE},
+				// in-memory history starts here
+				{at(20), at(25), STATUS_OFFLINE},
+				{at(25), at(60), STATUS_ONLINE},
+			},
+			1, 900,
+		},
+		{
+			"outages separated by online period",
+			[]Period{
+				{at(0), at(10), STATUS_OFFLINE},
+				{at(10), at(20), STATUS_ONLINE},
+				{at(20), at(30), STATUS_OFFLINE},
+				{at(30), at(60), STATUS_ONLINE},
+			},
+			2, 600,
+		},
+		{
+			"outages separated by gap",
+			[]Period{
+				{at(0), at(10), STATUS_OFFLINE},
+				{at(20), at(30), STATUS_OFFLINE},
+				{at(30), at(60), STATUS_ONLINE},
+			},
+			2, 600,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := windowReport("1h", c.periods, at(0), at(60))
+			if r.Outages != c.outages {
+				t.Errorf("got %d outages, expected %d", r.Outages, c.outages)
+			}
+			if r.MttrSeconds == nil || *r.MttrSeconds != c.mttr {
+				t.Errorf("got mttr %v, expected %v", r.MttrSeconds, c.mttr)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package workers
+
+import (
+	"log/slog"
+	"runtime"
+	"time"
+
+	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/registry"
+)
+
+// watchdog periodically checks that workers make progress and rebuilds the stalled ones,
+// stall is detected when online checker does not tick, pinger of active worker does not send probes
+// or worker mutex is not released for longer than PINGER_WATCHDOG_STALL_AFTER
+
+const (
+	STALL_REASON_CHECKER = "checker"
+	STALL_REASON_PROBE   = "probe"
+	STALL_REASON_MUTEX   = "mutex"
+)
+
+// longest time since the last online checker tick after which stalled worker is already rebuilt:
+// stall is detected once tick is older than PINGER_WATCHDOG_STALL_AFTER plus one checker interval,
+// and watchdog notices it within one PINGER_WATCHDOG_INTERVAL, zero means watchdog is disabled
+func RecoveryWindow() time.Duration {
+	conf := registry.Config
+	if conf.WatchdogInterval <= 0 {
+		return 0
+	}
+	return conf.WatchdogStallAfter + conf.OfflineCheckInterval + conf.WatchdogInterval
+}
+
+// start watchdog goroutine, returned func stops it,
+// zero PINGER_WATCHDOG_INTERVAL disables watchdog
+func (c *Collection) StartWatchdog() func() {
+	interval := registry.Config.WatchdogInterval
+	if interval <= 0 {
+		slog.Info(tagBase.F("Watchdog is disabled"))
+		return func() {}
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.checkStalled()
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+func (c *Collection) checkStalled() {
+	for _, worker := range c.List() {
+		reason := worker.stallReason(registry.Config.WatchdogStallAfter)
+		if reason == "" {
+			continue
+		}
+		now := time.Now()
+		lockBusy := time.Duration(0)
+		if !worker.lockBusySince.IsZero() {
+			lockBusy = now.Sub(worker.lockBusySince)
+		}
+		slog.Warn(
+			worker.tag.F("Worker is stalled, rebuilding"),
+			"reason", reason,
+			"lastTick", now.Sub(worker.LastTick()),
+			"lastSent", now.Sub(worker.LastSent()),
+			"lastRecv", now.Sub(worker.LastRecv()),
+			"lockBusy", lockBusy,
+			"goroutines", runtime.NumGoroutine(),
+		)
+		counters.WatchdogRecoveries.WithLabelValues(string(worker.target), reason).Inc()
+		counters.Errors.Inc()
+		if _, err := c.Rebuild(worker.target); err != nil {
+			slog.Error(worker.tag.F("Failed to rebuild worker"), "err", err)
+		}
+	}
+}
+
+// called only from watchdog goroutine, empty result means worker is healthy
+func (worker *Worker) stallReason(stallAfter time.Duration) string {
+	now := time.Now()
+	if worker.TryLock() {
+		worker.lockBusySince = time.Time{}
+		worker.Unlock()
+	} else if worker.lockBusySince.IsZero() {
+		worker.lockBusySince = now
+	} else if now.Sub(worker.lockBusySince) > stallAfter {
+		return STALL_REASON_MUTEX
+	}
+	if now.Sub(worker.LastTick()) > stallAfter+registry.Config.OfflineCheckInterval {
+		return STALL_REASON_CHECKER
+	}
+	// invalid, paused and off-schedule workers do not send probes
+	if !worker.invalid.Load() && worker.probing() && now.Sub(worker.LastSent()) > stallAfter+registry.Config.PingerInterval {
+		return STALL_REASON_PROBE
+	}
+	return ""
+}
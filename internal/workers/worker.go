@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fedulovivan/device-pinger/internal/counters"
 	"github.com/fedulovivan/device-pinger/internal/logger"
 	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/schedule"
 	"github.com/fedulovivan/mhz19-go/pkg/utils"
 	probing "github.com/prometheus-community/pro-bing"
 )
@@ -19,30 +21,112 @@ const (
 	STATUS_UNKNOWN OnlineStatus = -1
 	STATUS_OFFLINE OnlineStatus = 0
 	STATUS_ONLINE  OnlineStatus = 1
+	STATUS_PAUSED  OnlineStatus = 2
+	// out of monitoring window in suspend schedule mode
+	STATUS_OFF_SCHEDULE OnlineStatus = 3
+	// offline, while parent target is offline or unreachable too
+	STATUS_UNREACHABLE OnlineStatus = 4
 )
 
 var STATUS_NAMES = map[OnlineStatus]string{
-	STATUS_INVALID: "invalid",
-	STATUS_UNKNOWN: "unknown",
-	STATUS_OFFLINE: "offline",
-	STATUS_ONLINE:  "online",
+	STATUS_INVALID:      "invalid",
+	STATUS_UNKNOWN:      "unknown",
+	STATUS_OFFLINE:      "offline",
+	STATUS_ONLINE:       "online",
+	STATUS_PAUSED:       "paused",
+	STATUS_OFF_SCHEDULE: "off-schedule",
+	STATUS_UNREACHABLE:  "unreachable",
 }
 
+// what happens outside of the target monitoring window, PINGER_SCHEDULE_MODE is validated by registry
+const (
+	SCHEDULE_MODE_SUSPEND  = registry.SCHEDULE_MODE_SUSPEND
+	SCHEDULE_MODE_SUPPRESS = registry.SCHEDULE_MODE_SUPPRESS
+)
+
 var tagBase = utils.NewTag(logger.TAG_WRKR)
 
+// how many last round-trip times are kept for the sparklines
+const RTT_HISTORY_SIZE = 30
+
 type OnlineStatus int8
 
 type TargetAddr string
 
-type OnlineStatusChangeHandler func(
-	target TargetAddr,
-	status OnlineStatus,
-	lastSeen time.Time,
-	updSource UpdSource,
-)
+type OnlineStatusChangeHandler func(event StatusEvent)
+
+type PingHandler func(sample PingSample)
+
+// what is passed to the OnlineStatusChangeHandler,
+// also used as a data for the mqtt payload templates
+type StatusEvent struct {
+	// when the event happened, sinks handle events asynchronously and should use it instead of the current time
+	Ts        time.Time     `json:"ts"`
+	Target    TargetAddr    `json:"target"`
+	Status    OnlineStatus  `json:"status"`
+	LastSeen  time.Time     `json:"lastSeen"`
+	UpdSource UpdSource     `json:"updSource"`
+	Rtt       time.Duration `json:"-"`
+	Meta
+	// included into responses to mqtt get requests only
+	Report *Report `json:"report,omitempty"`
+}
+
+// single ping reply, unlike status events these are sent on every reply,
+// so consumers (like influx writer) could keep per-ping rtt detail
+type PingSample struct {
+	Target   TargetAddr
+	Status   OnlineStatus
+	Ts       time.Time
+	LastSeen time.Time
+	// zero for loss samples of silent target
+	Rtt time.Duration
+	// percent of echo requests lost since the previous sample, derived from gaps in sequence numbers
+	Loss float64
+	Meta
+}
+
+// extend json with human readable status and rtt in milliseconds
+func (e StatusEvent) MarshalJSON() ([]byte, error) {
+	type plain StatusEvent
+	return json.Marshal(struct {
+		plain
+		StatusName string  `json:"statusName"`
+		RttMs      float64 `json:"rttMs"`
+	}{
+		plain:      plain(e),
+		StatusName: e.StatusName(),
+		RttMs:      float64(e.Rtt.Microseconds()) / 1000,
+	})
+}
+
+// snapshot of the worker state, used in list responses
+type TargetInfo struct {
+	Target     TargetAddr   `json:"target"`
+	Status     OnlineStatus `json:"status"`
+	LastSeen   time.Time    `json:"lastSeen"`
+	ProbeType  string       `json:"probeType"`
+	RttHistory []float64    `json:"rttHistory"`
+	Meta
+	// included into responses to http get requests only
+	Report *Report `json:"report,omitempty"`
+}
+
+func (e StatusEvent) StatusName() string {
+	return STATUS_NAMES[e.Status]
+}
 
 type UpdSource byte
 
+type Meta struct {
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// monitoring windows, see schedule.Parse() for the format
+	Schedule string `json:"schedule,omitempty"`
+	// upstream target (like router or access point), which this target depends on
+	Parent TargetAddr `json:"parent,omitempty"`
+}
+
 func (s UpdSource) String() string {
 	return fmt.Sprintf("%v (id=%d)", UPD_SOURCE_NAMES[s], s)
 }
@@ -57,6 +141,10 @@ const (
 	UPD_SOURCE_ONLINE_CHECKER UpdSource = 3
 	UPD_SOURCE_PERIODIC       UpdSource = 4
 	UPD_SOURCE_PING_ON_RECV   UpdSource = 5
+	UPD_SOURCE_SNAPSHOT       UpdSource = 6
+	UPD_SOURCE_PAUSE          UpdSource = 7
+	UPD_SOURCE_RESUME         UpdSource = 8
+	UPD_SOURCE_SCHEDULE       UpdSource = 9
 )
 
 var UPD_SOURCE_NAMES = map[UpdSource]string{
@@ -65,19 +153,45 @@ var UPD_SOURCE_NAMES = map[UpdSource]string{
 	UPD_SOURCE_ONLINE_CHECKER: "online checker",
 	UPD_SOURCE_PERIODIC:       "periodic updater",
 	UPD_SOURCE_PING_ON_RECV:   "ping onrecv",
+	UPD_SOURCE_SNAPSHOT:       "snapshot",
+	UPD_SOURCE_PAUSE:          "pause",
+	UPD_SOURCE_RESUME:         "resume",
+	UPD_SOURCE_SCHEDULE:       "schedule",
 }
 
 type Worker struct {
 	sync.Mutex
 	onStatusChange  OnlineStatusChangeHandler
+	onPing          PingHandler
 	target          TargetAddr
+	meta            Meta
+	sharedMeta      atomic.Pointer[Meta] // copy of meta for lock-free reads by watchdog
+	schedule        *schedule.Schedule
 	pinger          *probing.Pinger
 	status          OnlineStatus
+	sharedStatus    atomic.Int32 // copy of status for lock-free reads by Status() and dependent workers
+	lookup          WorkerLookup
 	lastSeen        time.Time
+	rtt             time.Duration
+	rttHistory      []time.Duration
+	lastSeq         int          // sequence number of the last ping reply or loss sample, -1 for a fresh pinger
+	lastSentSeq     atomic.Int32 // sequence number of the last ping sent, -1 for a fresh pinger
+	history         *ring
+	createdAt       time.Time
 	onlineChecker   *time.Ticker
 	periodicUpdater *time.Ticker
+	lastTick        atomic.Int64 // unix nano of the last online checker tick, read without locking
+	lastSent        atomic.Int64 // unix nano of the last ping sent
+	lastRecv        atomic.Int64 // unix nano of the last ping reply
+	abandoned       atomic.Bool  // set by watchdog, when worker is replaced without graceful stop
+	paused          atomic.Bool  // changed under lock, read without locking by watchdog
+	offSchedule     atomic.Bool  // same as above, set when current time is out of monitoring window
+	resumedAt       time.Time
+	lockBusySince   time.Time // accessed only from watchdog goroutine
 	done            chan struct{}
-	invalid         bool
+	reportRequested chan struct{} // report gauges are refreshed outside of the lock, since report could read event log
+	doneOnce        sync.Once
+	invalid         atomic.Bool // set by pinger goroutine, read without locking by watchdog
 	tag             utils.Tag
 }
 
@@ -89,6 +203,15 @@ func (worker *Worker) Done() <-chan struct{} {
 	return worker.done
 }
 
+func (worker *Worker) stopped() bool {
+	select {
+	case <-worker.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func (worker *Worker) Stop() {
 	worker.Lock()
 	defer worker.Unlock()
@@ -96,20 +219,216 @@ func (worker *Worker) Stop() {
 	worker.pinger.Stop()
 	worker.onlineChecker.Stop()
 	worker.periodicUpdater.Stop()
-	worker.update_status_unsafe(STATUS_UNKNOWN, UPD_SOURCE_WORKER_STOP)
+	// stop event is always sent, since sinks detect deletion by it. paused worker keeps its status,
+	// so retained PAUSED status is not overwritten on shutdown, unknown one is not changed either
+	if worker.paused.Load() || worker.status == STATUS_UNKNOWN {
+		if !worker.abandoned.Load() {
+			worker.onStatusChange(worker.event_unsafe(worker.status, UPD_SOURCE_WORKER_STOP))
+		}
+	} else {
+		worker.update_status_unsafe(STATUS_UNKNOWN, UPD_SOURCE_WORKER_STOP)
+	}
 	slog.Info(worker.tag.F("Stopped"))
-	close(worker.done)
+	worker.doneOnce.Do(func() { close(worker.done) })
+}
+
+// stop worker without acquiring its mutex, which could be held forever by wedged goroutine,
+// status updates are not sent from abandoned worker anymore
+func (worker *Worker) abandon() {
+	worker.abandoned.Store(true)
+	worker.pinger.Stop()
+	worker.onlineChecker.Stop()
+	worker.periodicUpdater.Stop()
+	slog.Warn(worker.tag.F("Abandoned"))
+	worker.doneOnce.Do(func() { close(worker.done) })
+}
+
+func (worker *Worker) LastTick() time.Time {
+	return time.Unix(0, worker.lastTick.Load())
+}
+
+func (worker *Worker) LastSent() time.Time {
+	return time.Unix(0, worker.lastSent.Load())
+}
+
+func (worker *Worker) LastRecv() time.Time {
+	return time.Unix(0, worker.lastRecv.Load())
+}
+
+func (worker *Worker) Target() TargetAddr {
+	return worker.target
+}
+
+func (worker *Worker) Meta() Meta {
+	worker.Lock()
+	defer worker.Unlock()
+	return worker.meta
+}
+
+// new schedule is applied immediately
+func (worker *Worker) SetMeta(meta Meta) error {
+	sched, err := schedule.Parse(meta.Schedule)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSchedule, err)
+	}
+	if meta.Parent == worker.target {
+		return fmt.Errorf("%w: target cannot depend on itself", ErrInvalidParent)
+	}
+	worker.Lock()
+	defer worker.Unlock()
+	worker.meta = meta
+	worker.sharedMeta.Store(&meta)
+	worker.schedule = sched
+	worker.apply_schedule_unsafe(time.Now())
+	return nil
+}
+
+func (worker *Worker) Info() TargetInfo {
+	worker.Lock()
+	defer worker.Unlock()
+	rtts := make([]float64, len(worker.rttHistory))
+	for i, rtt := range worker.rttHistory {
+		rtts[i] = float64(rtt.Microseconds()) / 1000
+	}
+	return TargetInfo{
+		Target:     worker.target,
+		Status:     worker.status,
+		LastSeen:   worker.lastSeen,
+		ProbeType:  worker.ProbeType(),
+		RttHistory: rtts,
+		Meta:       worker.meta,
+	}
+}
+
+// unprivileged pinger uses udp datagram sockets, while privileged one uses raw icmp
+func (worker *Worker) ProbeType() string {
+	if worker.pinger.Privileged() {
+		return "icmp"
+	}
+	return "udp"
 }
 
 func (worker *Worker) Status() OnlineStatus {
-	return worker.status
+	return OnlineStatus(worker.sharedStatus.Load())
 }
 
 func (worker *Worker) LastSeen() time.Time {
 	return worker.lastSeen
 }
 
+func (worker *Worker) Paused() bool {
+	return worker.paused.Load()
+}
+
+func (worker *Worker) OffSchedule() bool {
+	return worker.offSchedule.Load()
+}
+
+// out of window in suppress mode, target is probed, but status transitions are not published
+func (worker *Worker) suppressed() bool {
+	return worker.offSchedule.Load() && registry.Config.ScheduleMode == SCHEDULE_MODE_SUPPRESS
+}
+
+// whether pinger should be running
+func (worker *Worker) probing() bool {
+	if worker.paused.Load() {
+		return false
+	}
+	return !worker.offSchedule.Load() || registry.Config.ScheduleMode == SCHEDULE_MODE_SUPPRESS
+}
+
+// check whether worker entered or left its monitoring window and start or stop probing accordingly
+func (worker *Worker) apply_schedule_unsafe(now time.Time) {
+	off := !worker.schedule.Active(now)
+	if off == worker.offSchedule.Load() {
+		return
+	}
+	wasProbing := worker.probing()
+	worker.offSchedule.Store(off)
+	slog.Info(worker.tag.F("Monitoring window changed"), "active", !off, "schedule", worker.schedule)
+	// paused worker is not affected, schedule is applied on resume
+	if worker.paused.Load() || wasProbing == worker.probing() {
+		return
+	}
+	if off {
+		worker.pinger.Stop()
+		worker.update_status_unsafe(STATUS_OFF_SCHEDULE, UPD_SOURCE_SCHEDULE)
+	} else {
+		worker.resumedAt = now
+		worker.update_status_unsafe(STATUS_UNKNOWN, UPD_SOURCE_SCHEDULE)
+		worker.start_pinger_unsafe()
+	}
+}
+
+// stop probing and periodic updates, paused status is published once
+func (worker *Worker) Pause() error {
+	worker.Lock()
+	defer worker.Unlock()
+	if worker.paused.Load() {
+		return ErrAlreadyPaused
+	}
+	worker.paused.Store(true)
+	worker.pinger.Stop()
+	worker.update_status_unsafe(STATUS_PAUSED, UPD_SOURCE_PAUSE)
+	slog.Info(worker.tag.F("Paused"))
+	return nil
+}
+
+// start probing with a fresh pinger, status is unknown until the first reply after resume
+func (worker *Worker) Resume() error {
+	worker.Lock()
+	defer worker.Unlock()
+	if !worker.paused.Load() {
+		return ErrNotPaused
+	}
+	worker.paused.Store(false)
+	slog.Info(worker.tag.F("Resumed"))
+	if !worker.probing() {
+		worker.update_status_unsafe(STATUS_OFF_SCHEDULE, UPD_SOURCE_RESUME)
+		return nil
+	}
+	worker.resumedAt = time.Now()
+	worker.update_status_unsafe(STATUS_UNKNOWN, UPD_SOURCE_RESUME)
+	worker.start_pinger_unsafe()
+	return nil
+}
+
+// round-trip time of the last received ping
+func (worker *Worker) Rtt() time.Duration {
+	return worker.rtt
+}
+
+// build event with the current status, lastSeen and metadata
+func (worker *Worker) Event(updSource UpdSource) StatusEvent {
+	worker.Lock()
+	defer worker.Unlock()
+	return worker.event_unsafe(worker.status, updSource)
+}
+
+func (worker *Worker) event_unsafe(status OnlineStatus, updSource UpdSource) StatusEvent {
+	return StatusEvent{
+		Ts:        time.Now(),
+		Target:    worker.target,
+		Status:    status,
+		LastSeen:  worker.lastSeen,
+		UpdSource: updSource,
+		Rtt:       worker.rtt,
+		Meta:      worker.meta,
+	}
+}
+
+// never blocks, pending request already covers the latest changes
+func (worker *Worker) request_report_unsafe() {
+	select {
+	case worker.reportRequested <- struct{}{}:
+	default:
+	}
+}
+
 func (worker *Worker) update_status_unsafe(status OnlineStatus, updSource UpdSource) {
+	if worker.abandoned.Load() {
+		return
+	}
 	if status != worker.status {
 		slog.Debug(
 			worker.tag.F("Status changed"),
@@ -118,36 +437,79 @@ func (worker *Worker) update_status_unsafe(status OnlineStatus, updSource UpdSou
 			"status",
 			STATUS_NAMES[status],
 		)
-		worker.onStatusChange(worker.target, status, worker.lastSeen, updSource /* , worker.tag */)
+		event := worker.event_unsafe(status, updSource)
+		worker.onStatusChange(event)
+		worker.history.push(Transition{
+			Ts:        event.Ts,
+			From:      worker.status,
+			To:        status,
+			UpdSource: updSource,
+			RttMs:     float64(worker.rtt.Microseconds()) / 1000,
+		})
 		worker.status = status
+		worker.sharedStatus.Store(int32(status))
+		worker.request_report_unsafe()
 	}
 }
 
+// prev is the worker being replaced by watchdog, its history is carried over, nil for a new target
 func New(
 	target TargetAddr,
+	meta Meta,
+	paused bool,
+	lookup WorkerLookup,
 	onStatusChange OnlineStatusChangeHandler,
+	onPing PingHandler,
+	prev *Worker,
 ) (*Worker, error) {
 
+	sched, err := schedule.Parse(meta.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSchedule, err)
+	}
+	if meta.Parent == target {
+		return nil, fmt.Errorf("%w: target cannot depend on itself", ErrInvalidParent)
+	}
+
 	// create instance
 	worker := &Worker{
-		target:         target,
-		status:         STATUS_UNKNOWN,
-		onStatusChange: onStatusChange,
-		tag:            tagBase.With("Ip=%s", target),
-		done:           make(chan struct{}),
+		target:          target,
+		meta:            meta,
+		schedule:        sched,
+		status:          STATUS_UNKNOWN,
+		onStatusChange:  onStatusChange,
+		onPing:          onPing,
+		lookup:          lookup,
+		history:         newRing(registry.Config.HistorySize),
+		createdAt:       time.Now(),
+		tag:             tagBase.With("Ip=%s", target),
+		done:            make(chan struct{}),
+		reportRequested: make(chan struct{}, 1),
 	}
-
-	var err error
-	worker.pinger, err = probing.NewPinger(string(target))
-	if err != nil {
-		counters.Errors.Inc()
-		slog.Error(worker.tag.F("Failed to complete probing.NewPinger()"), "err", err)
-		worker.invalid = true
+	if prev != nil {
+		worker.history = prev.history.clone()
+		worker.createdAt = prev.createdAt
 	}
-	worker.pinger.Interval = registry.Config.PingerInterval
 
-	// use logger adapter to write pinger messages with slog and with custom prefix
-	worker.pinger.SetLogger(SlogAdapter{worker.tag})
+	worker.sharedStatus.Store(int32(STATUS_UNKNOWN))
+	worker.sharedMeta.Store(&meta)
+	now := time.Now().UnixNano()
+	worker.lastTick.Store(now)
+	worker.lastSent.Store(now)
+
+	worker.paused.Store(paused)
+	worker.offSchedule.Store(!sched.Active(time.Now()))
+	if worker.probing() {
+		worker.start_pinger_unsafe()
+	} else {
+		// pinger is not started, but it is still needed for ProbeType() and Stop()
+		worker.pinger = probing.New(string(target))
+		if paused {
+			worker.update_status_unsafe(STATUS_PAUSED, UPD_SOURCE_PAUSE)
+		} else {
+			worker.update_status_unsafe(STATUS_OFF_SCHEDULE, UPD_SOURCE_SCHEDULE)
+		}
+	}
 
 	// start periodic checks to ensure device is still online
 	worker.onlineChecker = time.NewTicker(
@@ -160,16 +522,32 @@ func New(
 				return
 			case <-worker.onlineChecker.C:
 				worker.Lock()
+				worker.lastTick.Store(time.Now().UnixNano())
 				counters.OnlineCheckerTicks.WithLabelValues(string(worker.target)).Inc()
-				status := STATUS_UNKNOWN
-				if !worker.lastSeen.IsZero() {
+				worker.apply_schedule_unsafe(time.Now())
+				if !worker.probing() {
+					worker.Unlock()
+					continue
+				}
+				if worker.suppressed() {
+					// probes lost while suppressed should not be reported after it ends
+					worker.lastSeq = int(worker.lastSentSeq.Load())
+					worker.Unlock()
+					continue
+				}
+				worker.loss_sample_unsafe(time.Now())
+				status, hold := STATUS_UNKNOWN, false
+				// replies received before pause do not count
+				if !worker.lastSeen.IsZero() && !worker.lastSeen.Before(worker.resumedAt) {
 					if time.Now().Before(worker.lastSeen.Add(registry.Config.OfflineAfter)) {
 						status = STATUS_ONLINE
 					} else {
-						status = STATUS_OFFLINE
+						status, hold = worker.offline_status_unsafe()
 					}
 				}
-				worker.update_status_unsafe(status, UPD_SOURCE_ONLINE_CHECKER)
+				if !hold {
+					worker.update_status_unsafe(status, UPD_SOURCE_ONLINE_CHECKER)
+				}
 				worker.Unlock()
 
 			}
@@ -188,35 +566,125 @@ func New(
 			case <-worker.periodicUpdater.C:
 				worker.Lock()
 				counters.PeriodicUpdaterTicks.WithLabelValues(string(worker.target)).Inc()
-				worker.onStatusChange(worker.target, worker.status, worker.lastSeen, UPD_SOURCE_PERIODIC)
+				if !worker.abandoned.Load() && worker.probing() {
+					worker.onStatusChange(worker.event_unsafe(worker.status, UPD_SOURCE_PERIODIC))
+				}
+				worker.request_report_unsafe()
 				worker.Unlock()
+			case <-worker.reportRequested:
+				// gauges of deleted target should not be re-created
+				if !worker.abandoned.Load() && !worker.stopped() {
+					worker.export_report()
+				}
 			}
 		}
 	}()
 
+	slog.Info(worker.tag.F("Created"))
+
+	return worker, nil
+}
+
+// sequence numbers are 16 bit and wrap around, replies which arrived out of order are not counted as loss
+func (worker *Worker) ping_sample_unsafe(pkt *probing.Packet) PingSample {
+	lost := 0
+	if gap := (pkt.Seq - worker.lastSeq - 1 + 65536) % 65536; gap < 32768 {
+		lost = gap
+	}
+	worker.lastSeq = pkt.Seq
+	return PingSample{
+		Target:   worker.target,
+		Status:   worker.status,
+		Ts:       worker.lastSeen,
+		LastSeen: worker.lastSeen,
+		Rtt:      pkt.Rtt,
+		Loss:     100 * float64(lost) / float64(lost+1),
+		Meta:     worker.meta,
+	}
+}
+
+// ping samples are emitted on replies only, so silent target reports its loss with the checker instead:
+// probes sent since the last reply (or previous loss sample) are counted as lost, once target is silent
+// for longer than pinger and checker intervals, so replies which are still in flight are not counted
+func (worker *Worker) loss_sample_unsafe(now time.Time) {
+	sent := int(worker.lastSentSeq.Load())
+	if sent < 0 || sent == worker.lastSeq {
+		return
+	}
+	if now.Sub(worker.LastRecv()) <= registry.Config.PingerInterval+registry.Config.OfflineCheckInterval {
+		return
+	}
+	worker.lastSeq = sent
+	worker.onPing(PingSample{
+		Target:   worker.target,
+		Status:   worker.status,
+		Ts:       now,
+		LastSeen: worker.lastSeen,
+		Loss:     100,
+		Meta:     worker.meta,
+	})
+}
+
+// create and run new pinger, each pause stops the pinger for good, since stopped pinger cannot be restarted
+func (worker *Worker) start_pinger_unsafe() {
+	worker.invalid.Store(false)
+	worker.lastSeq = -1
+	worker.lastSentSeq.Store(-1)
+	worker.lastSent.Store(time.Now().UnixNano())
+
+	pinger, err := probing.NewPinger(string(worker.target))
+	if err != nil {
+		counters.Errors.Inc()
+		slog.Error(worker.tag.F("Failed to complete probing.NewPinger()"), "err", err)
+		worker.invalid.Store(true)
+	}
+	pinger.Interval = registry.Config.PingerInterval
+
+	// use logger adapter to write pinger messages with slog and with custom prefix
+	pinger.SetLogger(SlogAdapter{worker.tag})
+
+	pinger.OnSend = func(pkt *probing.Packet) {
+		worker.lastSent.Store(time.Now().UnixNano())
+		worker.lastSentSeq.Store(int32(pkt.Seq))
+	}
+
 	// update status and lastSeen
-	worker.pinger.OnRecv = func(pkt *probing.Packet) {
+	pinger.OnRecv = func(pkt *probing.Packet) {
+		worker.lastRecv.Store(time.Now().UnixNano())
 		worker.Lock()
 		defer worker.Unlock()
+		// late reply to the pinger, which was already stopped by pause
+		if worker.pinger != pinger || !worker.probing() {
+			return
+		}
 		worker.lastSeen = time.Now()
-		worker.update_status_unsafe(STATUS_ONLINE, UPD_SOURCE_PING_ON_RECV)
+		worker.rtt = pkt.Rtt
+		worker.rttHistory = append(worker.rttHistory, pkt.Rtt)
+		if len(worker.rttHistory) > RTT_HISTORY_SIZE {
+			worker.rttHistory = worker.rttHistory[1:]
+		}
+		if !worker.suppressed() {
+			worker.update_status_unsafe(STATUS_ONLINE, UPD_SOURCE_PING_ON_RECV)
+			worker.onPing(worker.ping_sample_unsafe(pkt))
+		} else {
+			worker.lastSeq = pkt.Seq
+		}
 	}
 
+	worker.pinger = pinger
+
+	invalid := worker.invalid.Load()
 	go func() {
-		if worker.invalid {
+		if invalid {
 			counters.Errors.Inc()
 			slog.Error(worker.tag.F("Cannot run pinger since worker already marked as invalid"))
 		} else {
-			err = worker.pinger.Run()
+			err := pinger.Run()
 			if err != nil {
 				counters.Errors.Inc()
 				slog.Error(worker.tag.F("Failed to complete pinger.Run()"), "err", err)
-				worker.invalid = true
+				worker.invalid.Store(true)
 			}
 		}
 	}()
-
-	slog.Info(worker.tag.F("Created"))
-
-	return worker, nil
 }
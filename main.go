@@ -9,22 +9,34 @@ import (
 
 	"net/http"
 
+	"github.com/fedulovivan/device-pinger/internal/api"
 	"github.com/fedulovivan/device-pinger/internal/counters"
+	"github.com/fedulovivan/device-pinger/internal/homie"
+	"github.com/fedulovivan/device-pinger/internal/influx"
+	"github.com/fedulovivan/device-pinger/internal/jsonlog"
 	"github.com/fedulovivan/device-pinger/internal/logger"
 	_ "github.com/fedulovivan/device-pinger/internal/logger"
 	"github.com/fedulovivan/device-pinger/internal/mqtt"
 	"github.com/fedulovivan/device-pinger/internal/registry"
+	"github.com/fedulovivan/device-pinger/internal/storage"
+	"github.com/fedulovivan/device-pinger/internal/summary"
+	"github.com/fedulovivan/device-pinger/internal/syslog"
+	"github.com/fedulovivan/device-pinger/internal/web"
+	"github.com/fedulovivan/device-pinger/internal/webhook"
 	workers_pkg "github.com/fedulovivan/device-pinger/internal/workers"
 	"github.com/fedulovivan/mhz19-go/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-
-	_ "net/http/pprof"
 )
 
 var tag = utils.NewTag(logger.TAG_MAIN)
 
 func main() {
 
+	// subcommands do not start the service
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExport(os.Args[2:]))
+	}
+
 	// record application start time
 	registry.RecordStartTime()
 
@@ -33,33 +45,109 @@ func main() {
 		slog.Info(tag.F("Running in developlment mode"))
 	}
 
+	// optional durable event log, webhooks, json lines log, syslog and influx writer
+	storage.Open()
+	if storage.Enabled() {
+		// availability reports cover time before the application start
+		workers_pkg.SetPeriodSource(storage.Periods)
+	}
+	webhook.Start()
+	jsonlog.Open()
+	syslog.Start()
+	influx.Start()
+
 	// create container to store and manage workers
 	workersCollection := workers_pkg.NewCollection()
+
+	// status events are always sent to regular mqtt topics and http stream clients,
+	// and optionally to homie device nodes, event log, webhooks, json lines log, syslog, influx and daily summary,
+	// every sink has its own buffer, so slow one does not delay the others
+	buffer := registry.Config.BusBuffer
+	workersCollection.Subscribe("mqtt", buffer, mqtt.SendStatus)
+	workersCollection.Subscribe("http", buffer, api.SendStatus)
+	if registry.Config.HomieEnabled {
+		workersCollection.Subscribe("homie", buffer, homie.SendStatus)
+	}
+	if storage.Enabled() {
+		workersCollection.Subscribe("storage", buffer, storage.SendStatus)
+	}
+	if storage.SamplesEnabled() {
+		workersCollection.SubscribePings("storage-ping", buffer, storage.SendPing)
+	}
+	if webhook.Enabled() {
+		workersCollection.Subscribe("webhook", buffer, webhook.SendStatus)
+	}
+	if jsonlog.Enabled() {
+		workersCollection.Subscribe("jsonl", buffer, jsonlog.SendStatus)
+	}
+	if syslog.Enabled() {
+		workersCollection.Subscribe("syslog", buffer, syslog.SendStatus)
+	}
+	// influx writer also gets every ping reply
+	if influx.Enabled() {
+		workersCollection.Subscribe("influx", buffer, influx.SendStatus)
+		workersCollection.SubscribePings("influx-ping", buffer, influx.SendPing)
+	}
+	if summary.Enabled() {
+		workersCollection.Subscribe("summary", buffer, summary.SendStatus)
+	}
+
 	go func() {
 		for len := range workersCollection.OnLenChange() {
 			counters.Workers.Set(float64(len))
+			if registry.Config.HomieEnabled {
+				homie.NotifyNodesChanged()
+			}
 		}
 	}()
 
+	// rebuild workers which stopped making progress
+	stopWatchdog := workersCollection.StartWatchdog()
+
+	// homie hooks should be registered before connect
+	if registry.Config.HomieEnabled {
+		homie.Init(workersCollection)
+	}
+
+	// daily presence summary, started before any worker is created, since it restores the current period from the event log
+	stopSummary := summary.Start()
+
 	// connect to mqtt broker
 	mqttDisconnect := mqtt.Connect(workersCollection)
 
-	// spawn workers
-	for _, target := range registry.Config.TargetIps {
-		go func(t string) {
-			_, err := workersCollection.Create(workers_pkg.TargetAddr(t), mqtt.SendStatus)
+	// spawn workers, parents should exist before their children are created
+	targets := make([]workers_pkg.TargetAddr, 0, len(registry.Config.TargetIps))
+	for _, t := range registry.Config.TargetIps {
+		targets = append(targets, workers_pkg.TargetAddr(t))
+	}
+	targets = workers_pkg.SortByParent(targets, func(t workers_pkg.TargetAddr) workers_pkg.TargetAddr {
+		return workers_pkg.TargetAddr(registry.Config.TargetParents[string(t)])
+	})
+	go func() {
+		for _, t := range targets {
+			_, err := workersCollection.Create(
+				t,
+				workers_pkg.Meta{
+					Name:     registry.Config.TargetNames[string(t)],
+					Labels:   registry.GetTargetLabels(string(t)),
+					Schedule: registry.Config.TargetSchedules[string(t)],
+					Parent:   workers_pkg.TargetAddr(registry.Config.TargetParents[string(t)]),
+				},
+			)
 			if err != nil {
 				counters.Errors.Inc()
-				slog.Error(tag.F("Unable to create worker"), "err", err.Error())
+				slog.Error(tag.F("Unable to create worker"), "target", t, "err", err.Error())
 			}
-		}(target)
-	}
+		}
+	}()
 
-	// dedicated prometheus http endpoint,
-	// since this app has no other http apis
+	// http server for prometheus metrics, pprof, rest api and status page
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		_ = http.ListenAndServe(fmt.Sprintf(":%d", registry.Config.PrometheusPort), nil)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		api.Register(mux, workersCollection)
+		web.Register(mux)
+		_ = http.ListenAndServe(fmt.Sprintf(":%d", registry.Config.PrometheusPort), mux)
 	}()
 
 	// handle shutdown
@@ -67,6 +155,8 @@ func main() {
 	signal.Notify(stopped, os.Interrupt, syscall.SIGTERM)
 	<-stopped
 	slog.Debug(tag.F("App termination signal received"))
+	stopWatchdog()
+	stopSummary()
 	workersCollection.StopAll()
 
 	// wait for the all workers to complete
@@ -75,7 +165,18 @@ func main() {
 		workersCollection.Wait()
 	}
 
+	// deliver events, which were sent by stopping workers, then flush sinks
+	workersCollection.CloseEvents()
+	storage.Close()
+	webhook.Stop()
+	jsonlog.Close()
+	syslog.Stop()
+	influx.Stop()
+
 	// disconnect from mqtt only after stopping workers
+	if registry.Config.HomieEnabled {
+		homie.Disconnect()
+	}
 	mqttDisconnect()
 
 	slog.Info(tag.F("All done, bye-bye"))